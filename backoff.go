@@ -0,0 +1,94 @@
+package sonar
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+var ErrMaxAttempts = errors.New("maximum number of attempts exceeded")
+
+// Backoff computes exponential backoff delays using the "full jitter" algorithm: the
+// delay before each attempt is chosen uniformly at random between zero and the
+// exponential ceiling min(Cap, Base * 2^attempt). Jitter prevents many clients that
+// failed together from retrying in lockstep. Supply a seeded rand.Source to make the
+// delays deterministic.
+type Backoff struct {
+	Base        time.Duration
+	Cap         time.Duration
+	MaxAttempts int // zero means retry forever
+	attempt     int
+	rand        *rand.Rand
+}
+
+func NewBackoff(base, cap time.Duration, maxAttempts int, src rand.Source) *Backoff {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+
+	return &Backoff{
+		Base:        base,
+		Cap:         cap,
+		MaxAttempts: maxAttempts,
+		rand:        rand.New(src),
+	}
+}
+
+// Next returns the delay before the next attempt, or false if the maximum number of
+// attempts has been reached.
+func (b *Backoff) Next() (time.Duration, bool) {
+	if b.MaxAttempts > 0 && b.attempt >= b.MaxAttempts {
+		return 0, false
+	}
+
+	ceiling := b.Ceiling(b.attempt)
+	b.attempt++
+
+	if ceiling <= 0 {
+		return 0, true
+	}
+	return time.Duration(b.rand.Int63n(int64(ceiling) + 1)), true
+}
+
+// Ceiling returns the maximum delay for the specified zero-indexed attempt.
+func (b *Backoff) Ceiling(attempt int) time.Duration {
+	ceiling := b.Base
+	for i := 0; i < attempt && ceiling < b.Cap; i++ {
+		ceiling *= 2
+	}
+
+	if ceiling > b.Cap {
+		return b.Cap
+	}
+	return ceiling
+}
+
+// Wait blocks for the next backoff delay, returning early if the context is done or
+// ErrMaxAttempts if no attempts remain.
+func (b *Backoff) Wait(ctx context.Context) error {
+	delay, ok := b.Next()
+	if !ok {
+		return ErrMaxAttempts
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Attempts returns the number of delays that have been issued since the last reset.
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Reset the backoff after a successful attempt.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
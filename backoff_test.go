@@ -0,0 +1,100 @@
+package sonar_test
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestBackoffCeiling(t *testing.T) {
+	b := sonar.NewBackoff(100*time.Millisecond, 2*time.Second, 0, nil)
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1600 * time.Millisecond,
+		2 * time.Second,
+		2 * time.Second,
+	}
+
+	for attempt, ceiling := range expected {
+		if got := b.Ceiling(attempt); got != ceiling {
+			t.Errorf("expected ceiling %s for attempt %d, got %s", ceiling, attempt, got)
+		}
+	}
+
+	// The ceiling must not overflow after many attempts.
+	if got := b.Ceiling(1000); got != 2*time.Second {
+		t.Errorf("expected ceiling to be capped after many attempts, got %s", got)
+	}
+}
+
+func TestBackoffNext(t *testing.T) {
+	b := sonar.NewBackoff(10*time.Millisecond, 100*time.Millisecond, 0, rand.NewSource(42))
+	for attempt := 0; attempt < 20; attempt++ {
+		delay, ok := b.Next()
+		if !ok {
+			t.Fatalf("expected unlimited attempts, stopped at attempt %d", attempt)
+		}
+
+		if delay < 0 || delay > b.Ceiling(attempt) {
+			t.Fatalf("delay %s for attempt %d is not within [0, %s]", delay, attempt, b.Ceiling(attempt))
+		}
+	}
+
+	if b.Attempts() != 20 {
+		t.Errorf("expected 20 attempts, got %d", b.Attempts())
+	}
+
+	b.Reset()
+	if b.Attempts() != 0 {
+		t.Errorf("expected attempts to be reset, got %d", b.Attempts())
+	}
+}
+
+func TestBackoffSeeded(t *testing.T) {
+	// Backoffs with the same seed produce the same delays.
+	a := sonar.NewBackoff(time.Millisecond, time.Second, 0, rand.NewSource(7))
+	b := sonar.NewBackoff(time.Millisecond, time.Second, 0, rand.NewSource(7))
+	for i := 0; i < 15; i++ {
+		da, _ := a.Next()
+		db, _ := b.Next()
+		if da != db {
+			t.Fatalf("expected seeded delays to match at attempt %d: %s != %s", i, da, db)
+		}
+	}
+}
+
+func TestBackoffMaxAttempts(t *testing.T) {
+	b := sonar.NewBackoff(0, 0, 3, nil)
+	for i := 0; i < 3; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatalf("expected attempt %d to be allowed: %s", i, err)
+		}
+	}
+
+	if _, ok := b.Next(); ok {
+		t.Fatal("expected no attempts to remain")
+	}
+
+	if err := b.Wait(context.Background()); !errors.Is(err, sonar.ErrMaxAttempts) {
+		t.Fatalf("expected max attempts error, got %v", err)
+	}
+}
+
+func TestBackoffWaitCancelled(t *testing.T) {
+	b := sonar.NewBackoff(time.Hour, time.Hour, 0, rand.NewSource(1))
+	b.Next() // the first delay may be zero with full jitter
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+}
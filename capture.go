@@ -0,0 +1,79 @@
+package sonar
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// MaxFrameSize limits the length of a captured ping so that a corrupt capture file does
+// not cause an arbitrarily large allocation when it is read.
+const MaxFrameSize = 1 << 24
+
+var ErrFrameTooLarge = errors.New("capture frame exceeds the maximum frame size")
+
+// Captured pings are written as length-prefixed frames so that a sequence of received
+// pings can be replayed with its original timing. The frame header is the time the ping
+// was received in big-endian unix nanoseconds followed by the big-endian uint32 length
+// of the msgpack encoded ping, which is followed by the ping itself.
+const frameHeaderSize = 12
+
+// WriteFrame appends the ping to the capture as a length-prefixed frame.
+func WriteFrame(w io.Writer, p *Ping) (err error) {
+	var data []byte
+	if data, err = p.Marshal(); err != nil {
+		return err
+	}
+
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	received := p.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(received.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(data)))
+
+	if _, err = w.Write(header[:]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadFrame reads the next ping from the capture, setting its received timestamp from
+// the frame. io.EOF is returned at the end of the capture and io.ErrUnexpectedEOF if the
+// capture ends part way through a frame.
+func ReadFrame(r io.Reader) (_ *Ping, err error) {
+	var header [frameHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[8:])
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	p := &Ping{}
+	if err = p.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	p.Received = time.Unix(0, int64(binary.BigEndian.Uint64(header[:8])))
+	return p, nil
+}
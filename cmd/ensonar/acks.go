@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	"github.com/rotationalio/go-ensign"
+)
+
+const (
+	ackPollInterval = time.Millisecond
+	ackTimeout      = 30 * time.Second
+	ackDrainTimeout = 2 * time.Second
+	ackBacklog      = 1024
+)
+
+// Tracks published events until they are acked to measure the publish-ack latency,
+// i.e. the time the broker takes to commit an event separately from end-to-end delivery.
+// The ensign client does not notify the publisher when an event is acked, so pending
+// events are polled in a go routine. Events that are nacked or not acked within the
+// timeout are dropped.
+type ackTracker struct {
+	stats   sonar.Stats
+	acked   uint64 // updated atomically so it can be read while tracking
+	pending chan pendingAck
+	done    chan struct{}
+}
+
+type pendingAck struct {
+	event *ensign.Event
+	sent  time.Time
+}
+
+func newAckTracker() *ackTracker {
+	t := &ackTracker{
+		pending: make(chan pendingAck, ackBacklog),
+		done:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Track an event that was published at the sent time.
+func (t *ackTracker) Track(event *ensign.Event, sent time.Time) {
+	t.pending <- pendingAck{event: event, sent: sent}
+}
+
+// Acked returns the number of events acked so far; it is safe to call while tracking.
+func (t *ackTracker) Acked() uint64 {
+	return atomic.LoadUint64(&t.acked)
+}
+
+// Close stops tracking and returns the publish-ack latency statistics. Events that are
+// still pending are polled until they are acked or the drain timeout has passed so that
+// the last pings published are not counted as unacked.
+func (t *ackTracker) Close() *sonar.Stats {
+	close(t.pending)
+	<-t.done
+	return &t.stats
+}
+
+func (t *ackTracker) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(ackPollInterval)
+	defer ticker.Stop()
+
+	var pending []pendingAck
+	for {
+		select {
+		case p, ok := <-t.pending:
+			if !ok {
+				t.drain(pending)
+				return
+			}
+			t.stats.Transmitted++
+			pending = append(pending, p)
+		case <-ticker.C:
+			pending = t.poll(pending)
+		}
+	}
+}
+
+func (t *ackTracker) drain(pending []pendingAck) {
+	deadline := time.Now().Add(ackDrainTimeout)
+	for pending = t.poll(pending); len(pending) > 0 && time.Now().Before(deadline); pending = t.poll(pending) {
+		time.Sleep(ackPollInterval)
+	}
+}
+
+// Observe the latency of acked events and return the events that are still pending.
+func (t *ackTracker) poll(pending []pendingAck) []pendingAck {
+	now := time.Now()
+	remaining := pending[:0]
+	for _, p := range pending {
+		acked, err := p.event.Acked()
+		switch {
+		case acked:
+			t.stats.Received++
+			atomic.AddUint64(&t.acked, 1)
+			t.stats.Observe(now.Sub(p.sent))
+		case err == nil && now.Sub(p.sent) < ackTimeout:
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	"github.com/vmihailenco/msgpack"
+)
+
+type encodedField struct {
+	name  string
+	key   []byte
+	value []byte
+}
+
+// Write an annotation of the msgpack encoding of the ping, showing the bytes of the
+// map header followed by the encoded key and value of each field in wire order.
+func annotate(w io.Writer, ping *sonar.Ping, data []byte) {
+	rv := reflect.ValueOf(ping).Elem()
+	rt := rv.Type()
+
+	fields := make([]encodedField, 0, rt.NumField())
+	nbytes := 0
+	for i := 0; i < rt.NumField(); i++ {
+		// Unexported fields such as the creation time are never encoded.
+		if !rt.Field(i).IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(rt.Field(i).Tag.Get("msgpack"), ",")
+		if name == "-" || (opts == "omitempty" && rv.Field(i).IsZero()) {
+			continue
+		}
+
+		field := encodedField{name: name}
+		field.key, _ = msgpack.Marshal(name)
+		field.value, _ = msgpack.Marshal(rv.Field(i).Interface())
+		fields = append(fields, field)
+		nbytes += len(field.key) + len(field.value)
+	}
+
+	// The map header precedes the first field
+	offset := len(data) - nbytes
+	if offset < 0 {
+		fmt.Fprintln(w, "could not annotate ping: field encoding does not match wire bytes")
+		return
+	}
+
+	fmt.Fprintf(w, "%04x  %-10s %s\n", 0, "(map)", hex.EncodeToString(data[:offset]))
+
+	for _, field := range fields {
+		fmt.Fprintf(w, "%04x  %-10s %s %s\n", offset, field.name, hex.EncodeToString(field.key), hex.EncodeToString(field.value))
+		offset += len(field.key) + len(field.value)
+	}
+}
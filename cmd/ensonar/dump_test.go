@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestDumpPing(t *testing.T) {
+	// The golden files do not have a token, which may be set in the environment.
+	t.Setenv("ENSIGN_SONAR_TOKEN", "")
+	os.Unsetenv("ENSIGN_SONAR_TOKEN")
+	for _, format := range []string{"msgpack", "json"} {
+		t.Run(format, func(t *testing.T) {
+			out, err := run(t, "dump-ping", "--format", format, "--seq", "1")
+			if err != nil {
+				t.Fatalf("could not dump ping: %s", err)
+			}
+
+			golden := filepath.Join("testdata", "dump-ping-"+format+".golden")
+			if *update {
+				if err = os.WriteFile(golden, []byte(out), 0644); err != nil {
+					t.Fatalf("could not update golden file: %s", err)
+				}
+			}
+
+			var expected []byte
+			if expected, err = os.ReadFile(golden); err != nil {
+				t.Fatalf("could not read golden file: %s", err)
+			}
+
+			if out != string(expected) {
+				t.Errorf("dump-ping output does not match %s:\n%s", golden, out)
+			}
+		})
+	}
+}
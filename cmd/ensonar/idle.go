@@ -0,0 +1,90 @@
+package main
+
+import "time"
+
+// Fires if no pings are received for the idle timeout, but only while a sender is
+// expected to send more pings. Senders are tracked by hostname: a sender that says
+// farewell has left cleanly, so once every sender has left the timer is stopped until
+// a ping from a new (or returning) sender is received. Before any pings have been
+// received the timer is running so that a listener that never hears from a sender
+// still times out. A zero timeout disables the timer.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	running bool
+	senders map[string]struct{} // senders that have not left
+	left    map[string]struct{} // senders that have left cleanly
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	t := &idleTimer{
+		timeout: timeout,
+		senders: make(map[string]struct{}),
+		left:    make(map[string]struct{}),
+	}
+
+	if timeout > 0 {
+		t.timer = time.NewTimer(timeout)
+		t.running = true
+	}
+	return t
+}
+
+// C returns the channel the timeout is delivered on; it is nil, and so never fires, if
+// the timer is disabled or every sender has left.
+func (t *idleTimer) C() <-chan time.Time {
+	if !t.running {
+		return nil
+	}
+	return t.timer.C
+}
+
+// Received resets the timer after a ping is received from the sender.
+func (t *idleTimer) Received(sender string) {
+	t.senders[sender] = struct{}{}
+	delete(t.left, sender)
+	if t.timer != nil {
+		t.stop()
+		t.timer.Reset(t.timeout)
+		t.running = true
+	}
+}
+
+// Farewell records that the sender has left cleanly, stopping the timer if it was the
+// last sender; it returns true if every sender has left.
+func (t *idleTimer) Farewell(sender string) bool {
+	delete(t.senders, sender)
+	t.left[sender] = struct{}{}
+	if len(t.senders) > 0 {
+		return false
+	}
+
+	if t.timer != nil {
+		t.stop()
+		t.running = false
+	}
+	return true
+}
+
+// Left returns the number of senders that have left cleanly and not returned.
+func (t *idleTimer) Left() int {
+	return len(t.left)
+}
+
+// Stop the timer, e.g. when the listener returns.
+func (t *idleTimer) Stop() {
+	if t.timer != nil {
+		t.stop()
+		t.running = false
+	}
+}
+
+// Stop the timer and drain its channel if it fired but was not received from.
+func (t *idleTimer) stop() {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+}
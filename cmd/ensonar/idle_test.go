@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns true if the idle timer fires within the wait.
+func fires(idle *idleTimer, wait time.Duration) bool {
+	select {
+	case <-idle.C():
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestIdleTimer(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	idle := newIdleTimer(timeout)
+	defer idle.Stop()
+
+	// The timer runs before any pings are received.
+	if !fires(idle, 10*timeout) {
+		t.Fatal("expected the idle timer to fire before any pings are received")
+	}
+
+	idle.Received("alpha")
+	idle.Received("bravo")
+	if idle.Farewell("alpha") {
+		t.Fatal("expected a sender to remain after the first farewell")
+	}
+
+	if !fires(idle, 10*timeout) {
+		t.Fatal("expected the idle timer to fire while a sender remains")
+	}
+
+	if !idle.Farewell("bravo") {
+		t.Fatal("expected every sender to have left after the last farewell")
+	}
+
+	if idle.C() != nil || fires(idle, 3*timeout) {
+		t.Fatal("expected the idle timer to be stopped once every sender has left")
+	}
+
+	if left := idle.Left(); left != 2 {
+		t.Errorf("expected 2 senders to have left, got %d", left)
+	}
+
+	// A returning sender restarts the timer.
+	idle.Received("alpha")
+	if left := idle.Left(); left != 1 {
+		t.Errorf("expected 1 sender to have left after a sender returned, got %d", left)
+	}
+
+	if !fires(idle, 10*timeout) {
+		t.Fatal("expected the idle timer to fire after a sender returned")
+	}
+}
+
+func TestIdleTimerDisabled(t *testing.T) {
+	idle := newIdleTimer(0)
+	defer idle.Stop()
+
+	idle.Received("alpha")
+	if idle.C() != nil {
+		t.Error("expected a disabled idle timer to never fire")
+	}
+
+	if !idle.Farewell("alpha") || idle.Left() != 1 {
+		t.Error("expected senders to be tracked when the idle timer is disabled")
+	}
+}
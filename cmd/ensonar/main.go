@@ -1,42 +1,114 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"sort"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	sonar "github.com/bbengfort/ensign-sonar"
 	"github.com/joho/godotenv"
+	"github.com/oklog/ulid/v2"
 	"github.com/rotationalio/go-ensign"
 	api "github.com/rotationalio/go-ensign/api/v1beta1"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-var client *ensign.Client
+var (
+	client     *ensign.Client
+	clientOpts []ensign.Option
+	progress   io.Writer = os.Stdout
+)
+
+// Signals that shut down a running command gracefully, e.g. SIGTERM from systemd or
+// Kubernetes, so that it prints its summary and the disconnect hook is run.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
 
 func main() {
 	// If a dotenv file exists load it for configuration
 	godotenv.Load()
 
-	// Create a multi-command CLI application
+	// Commands are run with a context that is cancelled when the process is interrupted
+	// so that blocking calls to the ensign node during setup can be cancelled.
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	if err := newApp().RunContext(ctx, os.Args); err != nil {
+		log.Fatal().Err(err).Msg("could not execute cli app")
+	}
+}
+
+// Creates the multi-command CLI application; main runs it with a context that is
+// cancelled when the process is interrupted.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "ensign-debug"
 	app.Version = sonar.Version()
 	app.Before = setupLogger
 	app.Usage = "sends and receives ping events to test ensign connectivity"
 	app.Flags = []cli.Flag{
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:    "topic",
 			Aliases: []string{"t"},
-			Usage:   "specify the sonar topic to use",
-			Value:   "sonar.ping",
+			Usage:   "specify the sonar topic to use (repeat to fan sonar pings across topics)",
+			Value:   cli.NewStringSlice("sonar.ping"),
 			EnvVars: []string{"ENSIGN_SONAR_TOPIC"},
 		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "correlation token to stamp on sent pings and to filter received pings by",
+			EnvVars: []string{"ENSIGN_SONAR_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "encrypt-key",
+			Usage:   "shared secret to encrypt sent pings and decrypt received pings with AES-GCM",
+			EnvVars: []string{"ENSIGN_SONAR_ENCRYPT_KEY"},
+		},
+		&cli.DurationFlag{
+			Name:  "topic-ready-timeout",
+			Usage: "how long to wait for a newly created topic to become available",
+			Value: 10 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "address of the ensign node (defaults to $" + ensign.EnvEndpoint + ")",
+		},
+		&cli.StringFlag{
+			Name:  "client-id",
+			Usage: "client id of the ensign api key (defaults to $" + ensign.EnvClientID + ")",
+		},
+		&cli.StringFlag{
+			Name:  "client-secret",
+			Usage: "client secret of the ensign api key (defaults to $" + ensign.EnvClientSecret + ")",
+		},
+		&cli.StringFlag{
+			Name:    "tls-ca",
+			Usage:   "path to a PEM encoded CA bundle to verify the broker certificate",
+			EnvVars: []string{"ENSIGN_TLS_CA"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-pin",
+			Usage:   "SHA-256 fingerprint of the broker certificate to pin",
+			EnvVars: []string{"ENSIGN_TLS_PIN"},
+		},
 		&cli.StringFlag{
 			Name:    "verbosity",
 			Aliases: []string{"L"},
@@ -51,20 +123,161 @@ func main() {
 			Value:   false,
 			EnvVars: []string{"ENSIGN_CONSOLE_LOG"},
 		},
+		&cli.BoolFlag{
+			Name:    "progress-stderr",
+			Usage:   "write progress output to stderr so that stdout only contains data",
+			Value:   false,
+			EnvVars: []string{"ENSIGN_PROGRESS_STDERR"},
+		},
 	}
 	app.Commands = []*cli.Command{
 		{
 			Name:   "sonar",
 			Usage:  "generate sonar pings and send to the specified topic",
-			Before: connect,
-			After:  disconnect,
+			Before: unlessDryRun(connect),
+			After:  unlessDryRun(disconnect),
 			Action: runSonar,
 			Flags: []cli.Flag{
-				&cli.Float64Flag{
+				&cli.StringFlag{
 					Name:    "rate",
 					Aliases: []string{"r"},
-					Usage:   "events to publish per second (-1 for as fast as possible)",
-					Value:   30,
+					Usage:   "events per second or per unit, e.g. 30, 100/s, 6000/min, 1/5s (-1 for as fast as possible)",
+					Value:   "30",
+				},
+				&cli.StringFlag{
+					Name:  "ramp-to",
+					Usage: "linearly increase the publish rate from --rate to this rate over the ramp duration",
+				},
+				&cli.DurationFlag{
+					Name:  "ramp-duration",
+					Usage: "duration of the publish rate ramp",
+					Value: time.Minute,
+				},
+				&cli.Uint64Flag{
+					Name:    "count",
+					Aliases: []string{"c"},
+					Usage:   "stop after sending this many pings (0 for unlimited)",
+				},
+				&cli.IntFlag{
+					Name:  "workers",
+					Usage: "publish with this many concurrent workers; the rate still limits how fast pings are produced",
+					Value: 1,
+				},
+				&cli.BoolFlag{
+					Name:  "flood",
+					Usage: "publish each ping as soon as the previous one is acked (unlike -1, bounds outstanding pings to one)",
+				},
+				&cli.BoolFlag{
+					Name:  "status",
+					Usage: "show a live status line with the publish and ack rates instead of progress dots",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "generate and print pings without connecting to ensign or publishing",
+				},
+				&cli.BoolFlag{
+					Name:  "log-events",
+					Usage: "log each publish as a structured debug event instead of printing progress",
+				},
+				&cli.Float64Flag{
+					Name:  "fail-threshold",
+					Usage: "exit with status 1 if more than this percentage of pings are not acked (disabled by default)",
+				},
+				&cli.BoolFlag{
+					Name:    "quiet",
+					Aliases: []string{"q"},
+					Usage:   "suppress per-ping progress output; errors and the summary are still printed",
+				},
+				&cli.DurationFlag{
+					Name:    "deadline",
+					Aliases: []string{"w"},
+					Usage:   "stop after publishing for this long regardless of the count (0 for unlimited)",
+				},
+				&cli.BoolFlag{
+					Name:  "farewell",
+					Usage: "publish a final farewell ping on shutdown so listeners know the sender left",
+				},
+				&cli.StringSliceFlag{
+					Name:  "meta",
+					Usage: "tag pings with key=value metadata (repeatable)",
+				},
+				&cli.StringFlag{
+					Name:  "marker",
+					Usage: "embed a known probe marker in every ping for consumer validation",
+				},
+				&cli.Uint64Flag{
+					Name:  "start-seq",
+					Usage: "sequence number of the first ping (listeners reject pings with sequence 0)",
+					Value: 1,
+				},
+				&cli.Uint64Flag{
+					Name:  "stride",
+					Usage: "increment between sequence numbers to interleave multiple publishers",
+					Value: 1,
+				},
+				&cli.StringFlag{
+					Name:  "hostname",
+					Usage: "override the detected hostname of the sender, e.g. with a service name",
+				},
+				&cli.StringFlag{
+					Name:  "ipaddr",
+					Usage: "override the detected outbound ip address of the sender",
+				},
+				&cli.DurationFlag{
+					Name:  "ttl",
+					Usage: "time to live of each ping, after which listeners report it as expired",
+					Value: sonar.DefaultTTL,
+				},
+				&cli.IntFlag{
+					Name:  "size",
+					Usage: "pad pings so each marshaled event is approximately this many bytes",
+				},
+				&cli.BoolFlag{
+					Name:  "no-create",
+					Usage: "exit with an error if a topic does not exist rather than creating it",
+				},
+				&cli.DurationFlag{
+					Name:  "connect-timeout",
+					Usage: "limit how long resolving the topics may take before publishing (0 for no limit)",
+					Value: 30 * time.Second,
+				},
+				&cli.StringFlag{
+					Name:  "reply-topic",
+					Usage: "measure round trip times from replies published to this topic by echo",
+				},
+				&cli.StringFlag{
+					Name:  "codec",
+					Usage: "serialization format of the pings (msgpack or json)",
+					Value: "msgpack",
+				},
+				&cli.IntFlag{
+					Name:  "max-retries",
+					Usage: "maximum attempts to reconnect after repeated publish errors (0 for unlimited)",
+					Value: 10,
+				},
+				&cli.DurationFlag{
+					Name:  "backoff-max",
+					Usage: "maximum delay between reconnect attempts",
+					Value: 30 * time.Second,
+				},
+			},
+		},
+		{
+			Name:   "echo",
+			Usage:  "reply to sonar pings on a reply topic so senders can measure round trip time",
+			Before: connect,
+			After:  disconnect,
+			Action: echo,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "reply-topic",
+					Usage: "topic to publish replies to, shared by all senders",
+					Value: "sonar.pong",
+				},
+				&cli.IntFlag{
+					Name:  "max-resubscribe",
+					Usage: "maximum attempts to resubscribe if the subscription closes (0 for unlimited)",
+					Value: 10,
 				},
 			},
 		},
@@ -74,13 +287,233 @@ func main() {
 			Before: connect,
 			After:  disconnect,
 			Action: listen,
-			Flags:  []cli.Flag{},
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Usage:   "output format of received pings (text or json)",
+					Value:   "text",
+				},
+				&cli.StringFlag{
+					Name:  "require-version",
+					Usage: "exit with an error if a ping's schema version does not match exactly",
+				},
+				&cli.StringFlag{
+					Name:  "unknown-mimetype",
+					Usage: "policy for events that are not pings: ack (skip) or nack (dlq is not supported by the ensign client)",
+					Value: "nack",
+				},
+				&cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "serve prometheus metrics on /metrics at this address",
+				},
+				&cli.StringFlag{
+					Name:  "statsd-addr",
+					Usage: "send ping latency metrics to the statsd server at this address",
+				},
+				&cli.StringFlag{
+					Name:  "statsd-prefix",
+					Usage: "namespace prefix for statsd metric names",
+					Value: sonar.DefaultStatsDPrefix,
+				},
+				&cli.DurationFlag{
+					Name:  "idle-timeout",
+					Usage: "exit with an error if no pings are received for this long (suspended once every sender has said farewell)",
+				},
+				&cli.BoolFlag{
+					Name:  "check-timestamps",
+					Usage: "warn when a ping's timestamp is earlier than a previous ping from the same host",
+				},
+				&cli.DurationFlag{
+					Name:  "clock-resolution",
+					Usage: "backwards timestamp jumps within this resolution are treated as ties",
+				},
+				&cli.Float64Flag{
+					Name:  "assert-rate",
+					Usage: "exit with an error if the receive rate in pings per second is not within tolerance",
+				},
+				&cli.Float64Flag{
+					Name:  "tolerance",
+					Usage: "fractional tolerance of the asserted receive rate",
+					Value: 0.1,
+				},
+				&cli.DurationFlag{
+					Name:  "rate-window",
+					Usage: "sliding window over which the asserted receive rate is measured",
+					Value: 5 * time.Second,
+				},
+				&cli.StringFlag{
+					Name:  "marker",
+					Usage: "verify that every ping carries this probe marker and report mismatches",
+				},
+				&cli.Uint64Flag{
+					Name:  "stride",
+					Usage: "expected increment between sequence numbers from each sender",
+					Value: 1,
+				},
+				&cli.StringFlag{
+					Name:  "shutdown-disposition",
+					Usage: "ack or nack events that were delivered but not handled at shutdown",
+					Value: "nack",
+				},
+				&cli.StringFlag{
+					Name:  "sqlite",
+					Usage: "write received pings to the pings table of a sqlite database at this path",
+				},
+				&cli.BoolFlag{
+					Name:  "histogram",
+					Usage: "print a distribution of latencies in buckets on shutdown",
+				},
+				&cli.IntFlag{
+					Name:  "sample-size",
+					Usage: "maximum number of latencies sampled to compute the latency percentiles",
+					Value: sonar.DefaultSampleSize,
+				},
+				&cli.IntFlag{
+					Name:  "max-resubscribe",
+					Usage: "maximum attempts to resubscribe if the subscription closes (0 for unlimited)",
+					Value: 10,
+				},
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "only handle pings from these comma separated hostnames or ip addresses (* globs allowed); other pings are nacked with DELIVER_AGAIN_NOT_ME so other consumers can receive them",
+				},
+				&cli.DurationFlag{
+					Name:  "max-age",
+					Usage: "log pings older than this when they are handled as stale (0 to disable)",
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "write a record of each received ping to a .csv or .json results file",
+				},
+				&cli.StringFlag{
+					Name:  "capture",
+					Usage: "append received pings to a capture file at this path to be replayed",
+				},
+			},
+		},
+		{
+			Name:   "replay",
+			Usage:  "republish pings from a capture file with their original timing",
+			Before: connect,
+			After:  disconnect,
+			Action: replay,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "file",
+					Aliases:  []string{"f"},
+					Usage:    "path to the capture file written by listen --capture",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:    "rate",
+					Aliases: []string{"r"},
+					Usage:   "replay at a fixed rate (e.g. 10/s or -1 for max) instead of the captured timing",
+				},
+			},
+		},
+		{
+			Name:   "rtt",
+			Usage:  "publish pings and receive them on the same topic to measure the round trip time",
+			Before: connect,
+			After:  disconnect,
+			Action: roundTrip,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "rate",
+					Aliases: []string{"r"},
+					Usage:   "events per second or per unit, e.g. 1, 100/s, 6000/min, 1/5s (-1 for as fast as possible)",
+					Value:   "1",
+				},
+				&cli.Uint64Flag{
+					Name:    "count",
+					Aliases: []string{"c"},
+					Usage:   "stop after sending this many pings (0 for unlimited)",
+				},
+				&cli.DurationFlag{
+					Name:    "deadline",
+					Aliases: []string{"w"},
+					Usage:   "stop after publishing for this long regardless of the count (0 for unlimited)",
+				},
+				&cli.DurationFlag{
+					Name:  "wait",
+					Usage: "how long to wait for the last pings to be received after sending stops",
+					Value: 2 * time.Second,
+				},
+			},
+		},
+		{
+			Name:   "topics",
+			Usage:  "list the topics visible to the client with their IDs",
+			Before: connect,
+			After:  disconnect,
+			Action: topics,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Usage:   "output format of the topic list (text or json)",
+					Value:   "text",
+				},
+			},
+		},
+		{
+			Name:   "profile",
+			Usage:  "measure the time and allocations to generate pings without a broker",
+			Action: profile,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "count",
+					Aliases: []string{"c"},
+					Usage:   "number of pings to generate",
+					Value:   100000,
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "accepted for consistency with sonar; profile never connects to ensign",
+				},
+			},
+		},
+		{
+			Name:   "dump-ping",
+			Usage:  "print the wire bytes of a single deterministic ping for decoder debugging",
+			Action: dumpPing,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "format",
+					Aliases: []string{"f"},
+					Usage:   "serialization format of the ping (msgpack or json)",
+					Value:   "msgpack",
+				},
+				&cli.Uint64Flag{
+					Name:  "seq",
+					Usage: "sequence number of the ping",
+					Value: 1,
+				},
+				&cli.StringFlag{
+					Name:  "timestamp",
+					Usage: "fixed RFC3339 timestamp of the ping",
+					Value: "2023-06-01T00:00:00Z",
+				},
+				&cli.StringFlag{
+					Name:  "hostname",
+					Usage: "fixed hostname of the ping",
+					Value: "localhost",
+				},
+				&cli.StringFlag{
+					Name:  "ipaddr",
+					Usage: "fixed ip address of the ping",
+					Value: "127.0.0.1",
+				},
+				&cli.BoolFlag{
+					Name:    "annotate",
+					Aliases: []string{"a"},
+					Usage:   "annotate the bytes of each field after the hex dump",
+				},
+			},
 		},
 	}
-
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal().Err(err).Msg("could not execute cli app")
-	}
+	return app
 }
 
 func setupLogger(c *cli.Context) (err error) {
@@ -110,16 +543,68 @@ func setupLogger(c *cli.Context) (err error) {
 	if c.Bool("console") {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
+
+	if c.Bool("progress-stderr") {
+		progress = os.Stderr
+	}
 	return nil
 }
 
+// Creates the global ensign client, keeping its options so that the client can be
+// recreated without logging in again to fetch TLS credentials.
 func connect(c *cli.Context) (err error) {
-	if client, err = ensign.New(); err != nil {
+	if clientOpts, err = clientOptions(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if client, err = ensign.New(clientOpts...); err != nil {
 		return cli.Exit(err, 1)
 	}
 	return nil
 }
 
+// Returns the options to create the ensign client with from the command line flags.
+// The endpoint and credentials are read from the environment if not specified.
+func clientOptions(c *cli.Context) (opts []ensign.Option, err error) {
+	endpoint, clientID, clientSecret := c.String("endpoint"), c.String("client-id"), c.String("client-secret")
+	creds := ensign.WithCredentials(clientID, clientSecret)
+
+	if ca, pin := c.String("tls-ca"), c.String("tls-pin"); ca != "" || pin != "" {
+		var conf *tls.Config
+		if conf, err = tlsConfig(ca, pin); err != nil {
+			return nil, err
+		}
+
+		if opts, err = tlsOptions(conf, endpoint, clientID, clientSecret); err != nil {
+			return nil, err
+		}
+		return append(opts, creds), nil
+	}
+
+	if endpoint != "" {
+		opts = append(opts, ensign.WithEnsignEndpoint(endpoint, false))
+	}
+	return append(opts, creds), nil
+}
+
+// Returns the cipher to encrypt and decrypt pings with, or nil if no key is specified.
+func cipherFrom(c *cli.Context) (*sonar.Cipher, error) {
+	if key := c.String("encrypt-key"); key != "" {
+		return sonar.NewCipher(key)
+	}
+	return nil, nil
+}
+
+// Wraps the connect and disconnect hooks so that they are skipped in dry-run mode.
+func unlessDryRun(hook func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if c.Bool("dry-run") {
+			return nil
+		}
+		return hook(c)
+	}
+}
+
 func disconnect(c *cli.Context) (err error) {
 	if err = client.Close(); err != nil {
 		return cli.Exit(err, 1)
@@ -128,115 +613,1427 @@ func disconnect(c *cli.Context) (err error) {
 }
 
 func runSonar(c *cli.Context) (err error) {
-	pings := sonar.New()
-	topic := c.String("topic")
+	var hz float64
+	if hz, err = sonar.ParseRate(c.String("rate")); err != nil {
+		return cli.Exit(err, 1)
+	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	count := uint64(0)
+	// When ramping the rate is recomputed as the run progresses rather than fixed.
+	var ramped *ramp
+	if spec := c.String("ramp-to"); spec != "" {
+		var to float64
+		if to, err = sonar.ParseRate(spec); err != nil {
+			return cli.Exit(err, 1)
+		}
 
-	var exists bool
-	if exists, err = client.TopicExists(context.Background(), topic); err != nil {
+		duration := c.Duration("ramp-duration")
+		if hz <= 0 || to <= 0 || duration <= 0 {
+			return cli.Exit("ramping requires positive start and end rates and a positive duration", 1)
+		}
+		ramped = newRamp(hz, to, duration)
+	}
+
+	var meta map[string]string
+	if meta, err = parseMeta(c.StringSlice("meta")); err != nil {
 		return cli.Exit(err, 1)
 	}
 
-	var topicID string
-	if !exists {
-		if topicID, err = client.CreateTopic(context.Background(), topic); err != nil {
+	var codec sonar.Codec
+	if codec, err = sonar.ParseCodec(c.String("codec")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	ttl := c.Duration("ttl")
+	if ttl <= 0 {
+		return cli.Exit(fmt.Errorf("invalid ttl %s: the ttl must be positive", ttl), 1)
+	}
+
+	// In quiet mode none of the progress output (including line resets) is written so
+	// that the summary is the only output, e.g. when scripted with --count.
+	dryRun, logEvents, flood := c.Bool("dry-run"), c.Bool("log-events"), c.Bool("flood")
+	if flood && ramped != nil {
+		return cli.Exit("cannot ramp the publish rate in flood mode", 1)
+	}
+
+	workers := c.Int("workers")
+	switch {
+	case workers < 1:
+		return cli.Exit(fmt.Errorf("invalid number of workers %d: at least one worker is required", workers), 1)
+	case workers > 1 && flood:
+		return cli.Exit("cannot publish with multiple workers in flood mode", 1)
+	}
+
+	if c.Bool("quiet") || logEvents || dryRun {
+		progress = io.Discard
+	}
+
+	// The status line replaces the progress dots, so it is written wherever the dots
+	// would have been and is disabled along with them, e.g. in quiet mode.
+	var statusOut io.Writer
+	if c.Bool("status") && progress != io.Discard {
+		statusOut, progress = progress, io.Discard
+	}
+
+	// Listeners reject pings without a sequence, so the sequence cannot start at zero.
+	if c.Uint64("start-seq") == 0 {
+		return cli.Exit("invalid start sequence 0: sequences start at 1", 1)
+	}
+
+	if dryRun && c.String("reply-topic") != "" {
+		return cli.Exit("cannot measure round trip times in dry-run mode", 1)
+	}
+
+	opts := []sonar.Option{
+		sonar.WithToken(c.String("token")),
+		sonar.WithMeta(meta),
+		sonar.WithMarker(c.String("marker")),
+		sonar.WithStartSequence(c.Uint64("start-seq")),
+		sonar.WithStride(c.Uint64("stride")),
+		sonar.WithSize(c.Int("size")),
+	}
+
+	// The hostname and ip address are detected unless they are overridden.
+	if hostname := c.String("hostname"); hostname != "" {
+		opts = append(opts, sonar.WithHostname(hostname))
+	}
+
+	if ipaddr := c.String("ipaddr"); ipaddr != "" {
+		if net.ParseIP(ipaddr) == nil {
+			return cli.Exit(fmt.Errorf("invalid ip address %q", ipaddr), 1)
+		}
+		opts = append(opts, sonar.WithIPAddress(ipaddr))
+	}
+	pings := sonar.NewWithTTL(ttl, opts...)
+	topics := c.StringSlice("topic")
+	topic := strings.Join(topics, ", ")
+
+	// The setup calls to the ensign node are bounded by the connect timeout and are
+	// cancelled if the process is interrupted rather than blocking on a hung node.
+	setup := c.Context
+	if d := c.Duration("connect-timeout"); d > 0 {
+		var cancel context.CancelFunc
+		setup, cancel = context.WithTimeout(setup, d)
+		defer cancel()
+	}
+
+	// Every topic is resolved before publishing so that pings are not lost while a topic
+	// is created; pings are published round-robin across the topics. In dry-run mode
+	// there is no client so the topic names are used in place of the IDs. With
+	// --no-create a missing topic is an error since creating it may mask a misconfiguration.
+	create := !c.Bool("no-create")
+	topicIDs := make([]string, len(topics))
+	topicNames := make(map[string]string, len(topics))
+	for i, name := range topics {
+		topicIDs[i] = name
+		if !dryRun {
+			if topicIDs[i], err = resolveTopic(setup, name, c.Duration("topic-ready-timeout"), create); err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+		topicNames[topicIDs[i]] = name
+	}
+
+	var seal *sonar.Cipher
+	if seal, err = cipherFrom(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// There is no client to reconnect in dry-run mode.
+	var reconnect *reconnector
+	if !dryRun {
+		reconnect = newReconnector(clientOpts, c.Int("max-retries"), c.Duration("backoff-max"))
+	}
+
+	// If a reply topic is specified, replies from echo responders are correlated with
+	// the pings sent by this host to measure the round trip time.
+	var rtts *sonar.RoundTrips
+	replyTopic := c.String("reply-topic")
+	if replyTopic != "" {
+		var replyID string
+		if replyID, err = resolveTopic(setup, replyTopic, c.Duration("topic-ready-timeout"), create); err != nil {
 			return cli.Exit(err, 1)
 		}
-	} else {
-		if topicID, err = client.TopicID(context.Background(), topic); err != nil {
+
+		var sub *ensign.Subscription
+		if sub, err = client.Subscribe(replyID); err != nil {
 			return cli.Exit(err, 1)
 		}
+		defer sub.Close()
+
+		rtts = sonar.NewRoundTrips()
+		go receiveReplies(sub, rtts, seal, pings.Hostname(), c.String("token"))
 	}
 
-	if hz := c.Float64("rate"); hz > 0 {
-		interval := time.Duration(float64(time.Second) / hz)
-		log.Info().Str("topic", topic).Float64("hz", hz).Dur("interval", interval).Msg("starting rate limited publisher")
+	// Published events are tracked until they are acked to measure publish-ack latency.
+	acks := newAckTracker()
 
-		ticker := time.NewTicker(interval)
-		for {
-			select {
-			case <-quit:
-				fmt.Println("")
-				return nil
-			case <-ticker.C:
-				count++
-				if count%64 == 0 {
-					fmt.Print("\033[2K\r")
-				}
+	// Before each ping is published it is recorded for the round trip latency; after it
+	// is published its progress is printed: x for errors, . if acked, + if not yet acked.
+	// With --log-events each publish is logged instead. In flood mode a dot is printed
+	// when a ping is sent and erased when it is acked, so the dots that remain are pings
+	// that were not acked. The publish-ack latency is measured from when the event was
+	// created, since with multiple workers the hooks of different pings interleave.
+	var pub *sonar.Publisher
 
-				ping := pings.Next().Event()
-				if err = client.Publish(topicID, ping); err != nil {
-					fmt.Print("x")
-					log.Error().Err(err).Msg("could not publish ping")
-					continue
-				}
+	before := func(ping *sonar.Ping) {
+		switch {
+		case flood:
+			fmt.Fprint(progress, ".")
+		case pub.Sent()%64 == 0:
+			fmt.Fprint(progress, "\033[2K\r")
+		}
 
-				if acked, err := ping.Acked(); err == nil && acked {
-					fmt.Print(".")
-				} else {
-					fmt.Print("+")
-				}
-			}
+		if rtts != nil {
+			rtts.Sent(ping)
 		}
-	} else {
-		log.Info().Str("topic", topic).Msg("starting max rate publisher")
-		for {
-			select {
-			case <-quit:
-				fmt.Println("")
-				return nil
-			default:
-			}
+	}
 
-			count++
-			if count%64 == 0 {
-				fmt.Print("\033[2K\r")
-			}
+	after := func(topicID string, ping *sonar.Ping, event *ensign.Event, err error) {
+		if ramped != nil {
+			ramped.Update(time.Now(), pub.Sent(), acks.Acked())
+		}
 
-			ping := pings.Next().Event()
-			if err = client.Publish(topicID, ping); err != nil {
-				fmt.Print("x")
-				log.Error().Err(err).Msg("could not publish ping")
-				continue
+		if err != nil {
+			if !flood {
+				fmt.Fprint(progress, "x")
 			}
+			log.Error().Err(err).Uint64("sequence", ping.Sequence).Str("topic", topicNames[topicID]).Msg("could not publish ping")
+			return
+		}
 
-			if acked, err := ping.Acked(); err == nil && acked {
-				fmt.Print(".")
-			} else {
-				fmt.Print("+")
-			}
+		if dryRun {
+			fmt.Printf("%s to %s (%d bytes)\n", ping, topicNames[topicID], len(event.Data))
+			return
+		}
+
+		reconnect.Success()
+		acks.Track(event, event.Created)
+
+		acked, _ := event.Acked()
+		if logEvents {
+			log.Debug().Uint64("sequence", ping.Sequence).Str("topic", topicNames[topicID]).Bool("acked", acked).Int("bytes", len(event.Data)).Msg("published ping")
+			return
+		}
+
+		switch {
+		case flood:
+			fmt.Fprint(progress, "\b \b")
+		case acked:
+			fmt.Fprint(progress, ".")
+		default:
+			fmt.Fprint(progress, "+")
 		}
 	}
-}
 
-func listen(c *cli.Context) (err error) {
-	topic := c.String("topic")
-	log.Info().Str("topic", topic).Msg("starting listener")
+	// After repeated publish errors the client is reconnected; the run is only stopped
+	// if the client could not be reconnected.
+	onError := func(error) (err error) {
+		if err = reconnect.Failure(c.Context); err == nil {
+			pub.SetClient(client)
+		}
+		return err
+	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	popts := []sonar.PublisherOption{
+		sonar.WithPings(pings),
+		sonar.WithCount(c.Uint64("count")),
+		sonar.WithCodec(codec),
+		sonar.WithCipher(seal),
+		sonar.WithFanout(topicIDs[1:]...),
+		sonar.WithHooks(before, after),
+	}
 
-	var sub *ensign.Subscription
-	if sub, err = client.Subscribe(); err != nil {
-		return cli.Exit(err, 1)
+	if dryRun {
+		popts = append(popts, sonar.DryRun())
+	} else {
+		popts = append(popts, sonar.WithErrorHandler(onError))
 	}
-	defer sub.Close()
 
-	for {
-		select {
-		case <-quit:
-			return nil
-		case event := <-sub.C:
-			ping := &sonar.Ping{}
-			if err = ping.Unmarshal(event.Data); err != nil {
-				log.Error().Err(err).Str("type", event.Type.String()).Str("mimetype", event.Mimetype.String()).Msg("could not unmarshal ping")
-				event.Nack(api.Nack_DELIVER_AGAIN_NOT_ME)
-				continue
-			}
-			fmt.Println(ping.String())
+	if flood {
+		popts = append(popts, sonar.Flood())
+	}
+
+	if workers > 1 {
+		popts = append(popts, sonar.WithWorkers(workers))
+	}
+
+	switch {
+	case flood:
+		log.Info().Strs("topics", topics).Msg("starting flood publisher")
+	case ramped != nil:
+		popts = append(popts, sonar.WithRateFunc(ramped.Rate))
+		log.Info().Strs("topics", topics).Float64("from", ramped.from).Float64("to", ramped.to).Dur("duration", ramped.duration).Msg("starting ramped publisher")
+	default:
+		popts = append(popts, sonar.WithRate(hz))
+		log.Info().Strs("topics", topics).Float64("hz", hz).Int("workers", workers).Msg("starting publisher")
+	}
+	pub = sonar.NewPublisher(client, topicIDs[0], popts...)
+
+	// The run completes when interrupted, when the deadline passes, or when the specified
+	// number of pings are sent; whichever comes first.
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	if d := c.Duration("deadline"); d > 0 {
+		var timeout context.CancelFunc
+		ctx, timeout = context.WithTimeout(ctx, d)
+		defer timeout()
+	}
+
+	var status *statusLine
+	if statusOut != nil {
+		status = newStatusLine(statusOut, pub, acks)
+		status.Start()
+	}
+
+	if ramped != nil {
+		ramped.Start(time.Now())
+	}
+	runErr := pub.Run(ctx)
+
+	fmt.Fprintln(progress, "")
+	if status != nil {
+		status.Stop()
+	}
+	if ramped != nil {
+		ramped.Report()
+	}
+
+	// Publish a farewell ping to every topic before returning if requested.
+	if c.Bool("farewell") {
+		if err = pub.Farewell(); err != nil {
+			log.Error().Err(err).Msg("could not publish farewell ping")
+		}
+	}
+
+	fmt.Printf("--- %s sonar statistics ---\n%s\n", topic, pub.Summary())
+	if len(topics) > 1 {
+		for i, name := range topics {
+			fmt.Printf("%s: %d pings published\n", name, pub.Published(topicIDs[i]))
+		}
+	}
+
+	acked := acks.Close()
+	if acked.Count() > 0 {
+		fmt.Printf("publish-ack min/avg/max = %0.3f/%0.3f/%0.3f ms (%d of %d acked)\n", milliseconds(acked.Min()), milliseconds(acked.Mean()), milliseconds(acked.Max()), acked.Received, acked.Transmitted)
+	}
+
+	if rtts != nil {
+		rtt := rtts.Stats()
+		fmt.Printf("--- %s round trip statistics ---\n%s\n", replyTopic, rtt.Summary())
+	}
+
+	if runErr != nil {
+		return cli.Exit(runErr, 1)
+	}
+
+	// Pings that failed to publish or were not acked count against the fail threshold;
+	// there are no acks in dry-run mode so the threshold is not checked.
+	if c.IsSet("fail-threshold") && !dryRun {
+		threshold := c.Float64("fail-threshold")
+		if sent := pub.Sent(); sent > 0 {
+			failed := float64(sent-acked.Received) / float64(sent) * 100
+			if failed > threshold {
+				return cli.Exit(fmt.Errorf("%0.1f%% of pings were not acked, exceeding the fail threshold of %0.1f%%", failed, threshold), 1)
+			}
+		}
+	}
+	return nil
+}
+
+// Receive the replies published by echo responders and correlate them with the pings
+// sent by this host. All senders share the reply topic, so replies are routed back to
+// their origin by the hostname of the original ping (and the token, if specified).
+func receiveReplies(sub *ensign.Subscription, rtts *sonar.RoundTrips, seal *sonar.Cipher, hostname, token string) {
+	for event := range sub.C {
+		reply, _, err := sonar.Decode(event, seal)
+		if err != nil || !reply.Echoed || reply.Hostname != hostname || reply.Token != token {
+			event.Ack()
+			continue
+		}
+
+		if rtt, ok := rtts.Replied(reply); ok {
+			log.Debug().Uint64("sequence", reply.Sequence).Dur("rtt", rtt).Msg("received reply")
+		}
+		event.Ack()
+	}
+}
+
+// Echo subscribes to the sonar topic and republishes every ping to the reply topic so
+// that the original sender can measure the round trip time. The replies keep the
+// hostname of the original ping, which each sender uses to pick out its own replies.
+func echo(c *cli.Context) (err error) {
+	var topic string
+	if topic, err = singleTopic(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	replyTopic := c.String("reply-topic")
+	if topic == replyTopic {
+		return cli.Exit(fmt.Errorf("reply topic must be different from the sonar topic %q", topic), 1)
+	}
+
+	var topicID, replyID string
+	if topicID, err = client.TopicID(c.Context, topic); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if replyID, err = resolveTopic(c.Context, replyTopic, c.Duration("topic-ready-timeout"), true); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var seal *sonar.Cipher
+	if seal, err = cipherFrom(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var sub *ensign.Subscription
+	if sub, err = client.Subscribe(topicID); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer func() { sub.Close() }()
+
+	log.Info().Str("topic", topic).Str("reply_topic", replyTopic).Msg("echoing pings")
+
+	var echoed, failed uint64
+	report := func() {
+		fmt.Printf("--- %s echo statistics ---\n%d pings echoed to %s, %d failed\n", topic, echoed, replyTopic, failed)
+	}
+
+	for {
+		select {
+		case <-c.Context.Done():
+			// The context is cancelled when the process is interrupted.
+			report()
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				sub.Close()
+				var next *ensign.Subscription
+				if next, err = resubscribe(c, topicID); err != nil {
+					if c.Context.Err() != nil {
+						report()
+						return nil
+					}
+					return cli.Exit(err, 1)
+				}
+				sub = next
+				continue
+			}
+
+			// Replies are encoded with the same codec as the ping they echo.
+			var (
+				ping  *sonar.Ping
+				codec sonar.Codec
+			)
+
+			if ping, codec, err = sonar.Decode(event, seal); err != nil {
+				switch {
+				case errors.Is(err, sonar.ErrDecrypt):
+					log.Error().Err(err).Msg("could not decrypt ping")
+					event.Nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+				case errors.Is(err, sonar.ErrUnknownMimetype):
+					log.Debug().Str("mimetype", event.Mimetype.String()).Msg("skipping event with unknown mimetype")
+					event.Nack(api.Nack_UNHANDLED_MIMETYPE)
+				default:
+					log.Error().Err(err).Msg("could not unmarshal ping")
+					event.Nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+				}
+				continue
+			}
+
+			// Never reply to a reply, otherwise responders could echo each other forever.
+			if ping.Echoed {
+				event.Ack()
+				continue
+			}
+
+			var reply *ensign.Event
+			if reply, err = ping.Reply().Event(codec); err == nil && seal != nil {
+				err = seal.Seal(reply)
+			}
+
+			if err == nil {
+				err = client.Publish(replyID, reply)
+			}
+
+			if err != nil {
+				failed++
+				log.Error().Err(err).Uint64("sequence", ping.Sequence).Str("hostname", ping.Hostname).Msg("could not publish reply")
+				event.Nack(api.Nack_DELIVER_AGAIN_ANY)
+				continue
+			}
+
+			echoed++
+			event.Ack()
+			log.Debug().Uint64("sequence", ping.Sequence).Str("hostname", ping.Hostname).Msg("echoed ping")
+		}
+	}
+}
+
+// Resubscribe with backoff after a subscription is closed, e.g. by a transient
+// disconnect, until the max-resubscribe attempts are exhausted or the context is done.
+func resubscribe(c *cli.Context, topics ...string) (sub *ensign.Subscription, err error) {
+	backoff := sonar.NewBackoff(100*time.Millisecond, 10*time.Second, c.Int("max-resubscribe"), nil)
+	for {
+		if err = backoff.Wait(c.Context); err != nil {
+			return nil, fmt.Errorf("could not resubscribe after %d attempts: %w", backoff.Attempts(), err)
+		}
+
+		log.Warn().Int("attempt", backoff.Attempts()).Msg("subscription closed, resubscribing")
+		if sub, err = client.Subscribe(topics...); err == nil {
+			return sub, nil
+		}
+		log.Error().Err(err).Int("attempt", backoff.Attempts()).Msg("could not resubscribe")
+	}
+}
+
+// Only the sonar command can fan out across multiple topics; the other commands require
+// exactly one topic.
+func singleTopic(c *cli.Context) (string, error) {
+	topics := c.StringSlice("topic")
+	if len(topics) != 1 {
+		return "", fmt.Errorf("specify exactly one topic for the %s command", c.Command.Name)
+	}
+	return topics[0], nil
+}
+
+// Publish pings and subscribe to the same topic, correlating every received ping with
+// the time it was sent by sequence. Unlike the latency reported by listen, the round trip
+// time is measured by a single process with the monotonic clock so it is not affected by
+// clock skew. Pings from other senders on the topic are ignored.
+func roundTrip(c *cli.Context) (err error) {
+	var topic string
+	if topic, err = singleTopic(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var hz float64
+	if hz, err = sonar.ParseRate(c.String("rate")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var seal *sonar.Cipher
+	if seal, err = cipherFrom(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var topicID string
+	if topicID, err = resolveTopic(c.Context, topic, c.Duration("topic-ready-timeout"), true); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	token := c.String("token")
+	pings := sonar.New(sonar.WithToken(token))
+	hostname := pings.Hostname()
+	rtts := sonar.NewRoundTrips()
+
+	handler := func(ping *sonar.Ping) error {
+		if ping.Echoed || ping.Hostname != hostname || ping.Token != token {
+			return nil
+		}
+
+		if rtt, ok := rtts.Replied(ping); ok {
+			fmt.Printf("%d bytes from %s: seq=%d rtt=%s\n", ping.Size(), topic, ping.Sequence, rtt)
+		}
+		return nil
+	}
+
+	// Pings are only published once the listener is subscribed so that none are missed.
+	subscribed := make(chan struct{})
+	listener := sonar.NewListener(client, handler,
+		sonar.SubscribeTo(topicID),
+		sonar.DecryptWith(seal),
+		sonar.OnSubscribe(func() { close(subscribed) }),
+		sonar.OnDecodeError(func(event *ensign.Event, err error) {
+			log.Debug().Err(err).Str("mimetype", event.Mimetype.String()).Msg("could not decode event")
+		}),
+	)
+
+	listening, stopListening := context.WithCancel(c.Context)
+	defer stopListening()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- listener.Listen(listening)
+	}()
+
+	select {
+	case err = <-stopped:
+		return cli.Exit(fmt.Errorf("could not subscribe to %s: %w", topic, err), 1)
+	case <-subscribed:
+	}
+
+	pub := sonar.NewPublisher(client, topicID,
+		sonar.WithPings(pings),
+		sonar.WithRate(hz),
+		sonar.WithCount(c.Uint64("count")),
+		sonar.WithCipher(seal),
+		sonar.WithHooks(rtts.Sent, nil),
+		sonar.WithErrorHandler(func(err error) error {
+			log.Error().Err(err).Msg("could not publish ping")
+			return nil
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	if d := c.Duration("deadline"); d > 0 {
+		var timeout context.CancelFunc
+		ctx, timeout = context.WithTimeout(ctx, d)
+		defer timeout()
+	}
+
+	log.Info().Str("topic", topic).Float64("hz", hz).Msg("measuring round trip times")
+	runErr := pub.Run(ctx)
+
+	// Wait for the pings that are still in flight unless the process was interrupted.
+	deadline := time.Now().Add(c.Duration("wait"))
+	for rtts.Pending() > 0 && time.Now().Before(deadline) && c.Context.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopListening()
+	if err = <-stopped; err != nil {
+		log.Error().Err(err).Msg("listener stopped")
+	}
+
+	stats := rtts.Stats()
+	fmt.Printf("--- %s round trip statistics ---\n%s\n", topic, stats.Summary())
+
+	if runErr != nil {
+		return cli.Exit(runErr, 1)
+	}
+	return nil
+}
+
+// Resolve the ID of the topic, creating it and waiting for it to become available if it
+// does not exist. If create is false an error is returned for a missing topic instead.
+func resolveTopic(ctx context.Context, topic string, timeout time.Duration, create bool) (topicID string, err error) {
+	var exists bool
+	if exists, err = client.TopicExists(ctx, topic); err != nil {
+		return "", err
+	}
+
+	if exists {
+		return client.TopicID(ctx, topic)
+	}
+
+	if !create {
+		return "", fmt.Errorf("topic %q does not exist and topic creation is disabled", topic)
+	}
+
+	if topicID, err = client.CreateTopic(ctx, topic); err != nil {
+		return "", err
+	}
+
+	if err = waitForTopic(ctx, topic, timeout); err != nil {
+		return "", err
+	}
+	return topicID, nil
+}
+
+// Topic creation may be eventually consistent, so poll until a newly created topic is
+// visible to avoid failing the first publishes.
+func waitForTopic(ctx context.Context, topic string, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := sonar.NewBackoff(50*time.Millisecond, time.Second, 0, nil)
+	for {
+		var exists bool
+		if exists, err = client.TopicExists(ctx, topic); err == nil && exists {
+			return nil
+		}
+
+		log.Debug().Err(err).Str("topic", topic).Int("attempt", backoff.Attempts()+1).Msg("waiting for topic to be ready")
+		if err = backoff.Wait(ctx); err != nil {
+			return fmt.Errorf("topic %q was not ready after %s", topic, timeout)
+		}
+	}
+}
+
+func topics(c *cli.Context) (err error) {
+	format := strings.ToLower(c.String("format"))
+	if format != "text" && format != "json" {
+		return cli.Exit(fmt.Errorf("unknown output format %q", format), 1)
+	}
+
+	var topics []*api.Topic
+	if topics, err = client.ListTopics(c.Context); err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return cli.Exit("the ensign node does not support listing topics", 1)
+		}
+		return cli.Exit(err, 1)
+	}
+
+	type topicInfo struct {
+		Name     string    `json:"name"`
+		ID       string    `json:"id"`
+		Offset   uint64    `json:"offset"`
+		Shards   uint32    `json:"shards"`
+		Readonly bool      `json:"readonly"`
+		Created  time.Time `json:"created"`
+	}
+
+	infos := make([]topicInfo, 0, len(topics))
+	for _, topic := range topics {
+		info := topicInfo{
+			Name:     topic.Name,
+			Offset:   topic.Offset,
+			Shards:   topic.Shards,
+			Readonly: topic.Readonly,
+			Created:  topic.Created.AsTime(),
+		}
+
+		var topicID ulid.ULID
+		if err = topicID.UnmarshalBinary(topic.Id); err == nil {
+			info.ID = topicID.String()
+		} else {
+			info.ID = hex.EncodeToString(topic.Id)
+		}
+		infos = append(infos, info)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(c.App.Writer)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(infos); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	}
+
+	tabs := tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tabs, "NAME\tID\tOFFSET\tSHARDS\tREADONLY")
+	for _, info := range infos {
+		fmt.Fprintf(tabs, "%s\t%s\t%d\t%d\t%t\n", info.Name, info.ID, info.Offset, info.Shards, info.Readonly)
+	}
+	return tabs.Flush()
+}
+
+func profile(c *cli.Context) (err error) {
+	count := c.Int("count")
+	if count <= 0 {
+		return cli.Exit("specify a positive number of pings to profile", 1)
+	}
+
+	var result *pingProfile
+	if result, err = profilePings(count, c.String("token")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Println(result)
+	log.Info().Int("count", count).Dur("elapsed", result.Elapsed).Msg("profile complete")
+	return nil
+}
+
+// The time and allocations per ping to generate pings and marshal them into events.
+type pingProfile struct {
+	N           uint64
+	Elapsed     time.Duration
+	BytesPerOp  uint64
+	AllocsPerOp uint64
+}
+
+func profilePings(count int, token string) (_ *pingProfile, err error) {
+	pings := sonar.New(sonar.WithToken(token))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		ping := pings.Next()
+		if _, err = ping.Event(sonar.MsgPackCodec{}); err != nil {
+			return nil, err
+		}
+		ping.Release()
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	n := uint64(count)
+	return &pingProfile{
+		N:           n,
+		Elapsed:     elapsed,
+		BytesPerOp:  (after.TotalAlloc - before.TotalAlloc) / n,
+		AllocsPerOp: (after.Mallocs - before.Mallocs) / n,
+	}, nil
+}
+
+func (p *pingProfile) NsPerOp() int64 {
+	return p.Elapsed.Nanoseconds() / int64(p.N)
+}
+
+// String returns the profile in the Go benchmark format so that it can be compared
+// with benchstat.
+func (p *pingProfile) String() string {
+	return fmt.Sprintf("BenchmarkPingEvent\t%d\t%d ns/op\t%d B/op\t%d allocs/op", p.N, p.NsPerOp(), p.BytesPerOp, p.AllocsPerOp)
+}
+
+func dumpPing(c *cli.Context) (err error) {
+	var codec sonar.Codec
+	if codec, err = sonar.ParseCodec(c.String("format")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if _, ok := codec.(sonar.MsgPackCodec); !ok && c.Bool("annotate") {
+		return cli.Exit("annotations are only supported for the msgpack format", 1)
+	}
+
+	ping := &sonar.Ping{
+		Sequence:  c.Uint64("seq"),
+		Hostname:  c.String("hostname"),
+		IPAddress: c.String("ipaddr"),
+		TTL:       sonar.DefaultTTL,
+		Token:     c.String("token"),
+	}
+
+	if ping.Timestamp, err = time.Parse(time.RFC3339, c.String("timestamp")); err != nil {
+		return cli.Exit(fmt.Errorf("could not parse timestamp: %w", err), 1)
+	}
+
+	var data []byte
+	if data, err = codec.Marshal(ping); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Fprint(c.App.Writer, hex.Dump(data))
+	if c.Bool("annotate") {
+		fmt.Fprintln(c.App.Writer, "")
+		annotate(c.App.Writer, ping, data)
+	}
+	return nil
+}
+
+func listen(c *cli.Context) (err error) {
+	var topic string
+	if topic, err = singleTopic(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+	log.Info().Str("topic", topic).Msg("starting listener")
+	token := c.String("token")
+
+	var seal *sonar.Cipher
+	if seal, err = cipherFrom(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var required *api.Type
+	if version := c.String("require-version"); version != "" {
+		if required, err = parseSchemaVersion(version); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	unknownMimetype := strings.ToLower(c.String("unknown-mimetype"))
+	switch unknownMimetype {
+	case "ack", "nack":
+	case "dlq":
+		return cli.Exit("dead letter queues are not supported by the ensign client", 1)
+	default:
+		return cli.Exit(fmt.Errorf("unknown mimetype policy %q: specify ack or nack", unknownMimetype), 1)
+	}
+
+	// In json mode stdout only contains JSON lines, so the summary is written to stderr.
+	format, out, summary := strings.ToLower(c.String("format")), c.App.Writer, c.App.Writer
+	switch format {
+	case "text":
+	case "json":
+		summary = c.App.ErrWriter
+	default:
+		return cli.Exit(fmt.Errorf("unknown output format %q", format), 1)
+	}
+
+	disposition := strings.ToLower(c.String("shutdown-disposition"))
+	if disposition != "ack" && disposition != "nack" {
+		return cli.Exit(fmt.Errorf("unknown shutdown disposition %q: specify ack or nack", disposition), 1)
+	}
+
+	// The metrics server is shut down before returning so that it stops serving before
+	// the client is closed by the disconnect hook.
+	var metrics *sonar.Metrics
+	if addr := c.String("metrics-addr"); addr != "" {
+		metrics = sonar.NewMetrics()
+
+		var srv *http.Server
+		if srv, err = metrics.Serve(addr); err != nil {
+			return cli.Exit(err, 1)
+		}
+		log.Info().Str("addr", addr).Msg("serving prometheus metrics")
+
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Error().Err(err).Msg("could not shutdown metrics server")
+			}
+		}()
+	}
+
+	var statsd *sonar.StatsD
+	if addr := c.String("statsd-addr"); addr != "" {
+		if statsd, err = sonar.NewStatsD(addr, c.String("statsd-prefix")); err != nil {
+			return cli.Exit(err, 1)
+		}
+		defer statsd.Close()
+	}
+
+	// Pings written to sqlite are committed periodically even if the batch is not full.
+	var (
+		db       *sqliteWriter
+		dbCommit <-chan time.Time
+	)
+	if path := c.String("sqlite"); path != "" {
+		if db, err = openSQLite(path); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		ticker := time.NewTicker(sqliteBatchInterval)
+		defer ticker.Stop()
+		dbCommit = ticker.C
+
+		defer func() {
+			if err := db.Close(); err != nil {
+				log.Error().Err(err).Msg("could not close sqlite database")
+			}
+		}()
+	}
+
+	var results *resultsWriter
+	if path := c.String("output"); path != "" {
+		if results, err = openResults(path); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		defer func() {
+			if err := results.Close(); err != nil {
+				log.Error().Err(err).Msg("could not close results file")
+			}
+		}()
+	}
+
+	// Captured pings are buffered, so the capture is flushed before it is closed.
+	var capture *bufio.Writer
+	if path := c.String("capture"); path != "" {
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		capture = bufio.NewWriter(f)
+		defer func() {
+			if err := capture.Flush(); err != nil {
+				log.Error().Err(err).Msg("could not flush capture file")
+			}
+			f.Close()
+		}()
+	}
+
+	var from []string
+	if filters := c.String("from"); filters != "" {
+		for _, filter := range strings.Split(filters, ",") {
+			if filter = strings.TrimSpace(filter); filter != "" {
+				from = append(from, filter)
+			}
+		}
+	}
+
+	stats := &sonar.Stats{}
+	seqs := sonar.NewSequenceTracker(c.Uint64("stride"))
+
+	var stale uint64
+	maxAge := c.Duration("max-age")
+
+	// Jitter is computed from consecutive pings from the same sender.
+	jitters := make(map[string]*sonar.Jitter)
+
+	var histogram *sonar.Histogram
+	if c.Bool("histogram") {
+		histogram = sonar.NewHistogram()
+	}
+	percentiles := sonar.NewPercentiles(c.Int("sample-size"))
+	var matched, mismatched uint64
+	marker := c.String("marker")
+	if marker != "" {
+		defer func() {
+			log.Info().Uint64("matched", matched).Uint64("mismatched", mismatched).Msg("probe marker validation")
+		}()
+	}
+
+	var decryptFailures uint64
+	var order *sonar.OrderChecker
+	if c.Bool("check-timestamps") {
+		order = sonar.NewOrderChecker(c.Duration("clock-resolution"))
+	}
+
+	var sub *ensign.Subscription
+	if sub, err = client.Subscribe(); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer func() { sub.Close() }()
+
+	// Every event is settled exactly once; the inflight event has been received but not
+	// yet settled. If listen returns before an event is settled, e.g. because of a schema
+	// mismatch, its disposition is made explicit rather than left to the broker, as is the
+	// disposition of events delivered to the subscription that were not yet received.
+	var inflight *ensign.Event
+	ack := func() {
+		inflight.Ack()
+		inflight = nil
+	}
+
+	nack := func(code api.Nack_Code) {
+		inflight.Nack(code)
+		inflight = nil
+	}
+
+	defer func() {
+		settled := drain(sub, disposition)
+		if inflight != nil {
+			settle(inflight, disposition)
+			settled++
+		}
+
+		if settled > 0 {
+			log.Debug().Str("disposition", disposition).Int("events", settled).Msg("settled unhandled events on shutdown")
+		}
+	}()
+
+	// The idle timer is reset every time a ping is received and stopped once every
+	// sender has said farewell.
+	timeout := c.Duration("idle-timeout")
+	idle := newIdleTimer(timeout)
+	defer idle.Stop()
+
+	// The receive rate is checked every second once the first full window has elapsed.
+	var (
+		rates     *sonar.RateWindow
+		rateCheck <-chan time.Time
+	)
+	expected, tolerance := c.Float64("assert-rate"), c.Float64("tolerance")
+	if expected > 0 {
+		window := c.Duration("rate-window")
+		if window <= 0 {
+			return cli.Exit(fmt.Errorf("invalid rate window %s: the window must be positive", window), 1)
+		}
+
+		if tolerance < 0 {
+			return cli.Exit(fmt.Errorf("invalid tolerance %0.2f: the tolerance cannot be negative", tolerance), 1)
+		}
+
+		rates = sonar.NewRateWindow(window)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		rateCheck = ticker.C
+	}
+	started := time.Now()
+
+	// The summary is printed when the listener is interrupted, including while it is
+	// waiting to resubscribe.
+	report := func() {
+		stats.Transmitted = seqs.Expected()
+		printSummary(summary, topic, stats)
+		if percentiles.Count() > 0 {
+			fmt.Fprintln(summary, percentiles)
+		}
+		if reordered := seqs.Reordered(); reordered > 0 {
+			fmt.Fprintf(summary, "%d pings received out of order\n", reordered)
+		}
+
+		if duplicates := seqs.Duplicates(); duplicates > 0 {
+			fmt.Fprintf(summary, "%d duplicate pings ignored\n", duplicates)
+		}
+
+		if stale > 0 {
+			fmt.Fprintf(summary, "%d pings older than %s when handled\n", stale, maxAge)
+		}
+
+		if marker != "" {
+			fmt.Fprintf(summary, "%d pings matched the probe marker, %d mismatched\n", matched, mismatched)
+		}
+
+		if left := idle.Left(); left > 0 {
+			fmt.Fprintf(summary, "%d senders left cleanly\n", left)
+		}
+
+		if len(jitters) > 0 {
+			hosts := make([]string, 0, len(jitters))
+			for host := range jitters {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+
+			for _, host := range hosts {
+				fmt.Fprintf(summary, "jitter from %s = %0.3f ms\n", host, milliseconds(jitters[host].Jitter()))
+			}
+		}
+
+		if histogram != nil {
+			fmt.Fprintf(summary, "latency distribution:\n%s", histogram)
+		}
+	}
+
+	for {
+		select {
+		case <-c.Context.Done():
+			// The context is cancelled when the process is interrupted.
+			report()
+			return nil
+		case now := <-rateCheck:
+			if now.Sub(started) < rates.Window {
+				continue
+			}
+
+			if observed := rates.Rate(now); !sonar.Within(observed, expected, tolerance) {
+				log.Error().Float64("observed", observed).Float64("expected", expected).Float64("tolerance", tolerance).Msg("receive rate out of tolerance")
+				return cli.Exit(fmt.Errorf("observed receive rate %0.2f/s is not within %0.0f%% of %0.2f/s", observed, tolerance*100, expected), 1)
+			}
+		case <-dbCommit:
+			if err = db.Commit(); err != nil {
+				log.Error().Err(err).Msg("could not commit pings to sqlite")
+			}
+		case <-idle.C():
+			log.Error().Dur("idle_timeout", timeout).Msg("listener idle timeout")
+			return cli.Exit(fmt.Errorf("idle timeout: no pings received in %s", timeout), 1)
+		case event, ok := <-sub.C:
+			// If the subscription is closed, e.g. by a transient disconnect, resubscribe;
+			// the sequence tracker and statistics are preserved across subscriptions.
+			if !ok {
+				sub.Close()
+				var next *ensign.Subscription
+				if next, err = resubscribe(c); err != nil {
+					if c.Context.Err() != nil {
+						report()
+						return nil
+					}
+					return cli.Exit(err, 1)
+				}
+				sub = next
+				continue
+			}
+
+			inflight = event
+			ping, _, err := sonar.Decode(event, seal)
+			switch {
+			case errors.Is(err, sonar.ErrDecrypt):
+				decryptFailures++
+				log.Error().Err(err).Uint64("failures", decryptFailures).Msg("could not decrypt ping")
+				nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+				continue
+			case errors.Is(err, sonar.ErrUnknownMimetype):
+				log.Debug().Str("mimetype", event.Mimetype.String()).Str("policy", unknownMimetype).Msg("skipping event with unknown mimetype")
+				if unknownMimetype == "ack" {
+					ack()
+				} else {
+					nack(api.Nack_UNHANDLED_MIMETYPE)
+				}
+				continue
+			}
+
+			// The schema is checked before unmarshal errors, which a mismatch may cause.
+			if required != nil && (event.Type == nil || !required.Equals(event.Type)) {
+				received := "unknown"
+				if event.Type != nil {
+					received = event.Type.Version()
+				}
+				log.Error().Str("required", required.Version()).Str("received", received).Msg("ping schema version mismatch")
+				return cli.Exit(fmt.Errorf("received ping with schema %s, require %s", received, required.Version()), 1)
+			}
+
+			if err != nil {
+				log.Error().Err(err).Str("type", event.Type.String()).Str("mimetype", event.Mimetype.String()).Msg("could not unmarshal ping")
+				nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+				if statsd != nil {
+					statsd.Count("errors", 1)
+				}
+				if metrics != nil {
+					metrics.Failures.Inc()
+				}
+				continue
+			}
+
+			if err = ping.Validate(); err != nil {
+				log.Warn().Err(err).Str("hostname", ping.Hostname).Uint64("sequence", ping.Sequence).Msg("received invalid ping")
+				nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+				continue
+			}
+
+			// Pings from other senders are not acked or counted; they are nacked so that the
+			// broker can deliver them to other consumers that may be interested in them.
+			if !ping.MatchesAny(from) {
+				nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+				continue
+			}
+
+			// Pings from other runs sharing the topic are acked so they are not redelivered.
+			if token != "" && ping.Token != token {
+				ack()
+				continue
+			}
+
+			idle.Received(ping.Hostname)
+
+			// Redelivered pings are acked but not counted again so that they cannot hide a
+			// gap in the sequence.
+			next, lost, reordered, duplicate := seqs.Track(ping)
+			if duplicate {
+				log.Debug().Str("hostname", ping.Hostname).Uint64("sequence", ping.Sequence).Msg("duplicate ping")
+				ack()
+				continue
+			}
+
+			if lost > 0 {
+				log.Warn().Str("hostname", ping.Hostname).Msgf("seq gap: expected %d got %d (%d lost)", next, ping.Sequence, lost)
+			} else if reordered {
+				log.Warn().Str("hostname", ping.Hostname).Msgf("seq reordered: expected %d got %d", next, ping.Sequence)
+			}
+
+			stats.Received++
+			stats.Observe(ping.Timedelta())
+			percentiles.Add(ping.Timedelta())
+			if histogram != nil {
+				histogram.Observe(ping.Timedelta())
+			}
+
+			if ping.Expired() {
+				stats.Expired++
+			}
+
+			jitter, ok := jitters[ping.Hostname]
+			if !ok {
+				jitter = &sonar.Jitter{}
+				jitters[ping.Hostname] = jitter
+			}
+			jitter.Observe(ping.Timedelta())
+
+			// Stale pings were sent long before they were handled, e.g. while draining a
+			// backlog, so their latency does not reflect the current state of the broker.
+			if age := ping.Age(); maxAge > 0 && age > maxAge {
+				stale++
+				log.Warn().Bool("stale", true).Dur("age", age).Str("hostname", ping.Hostname).Uint64("sequence", ping.Sequence).Msg("received stale ping")
+			}
+
+			if rates != nil {
+				rates.Observe(ping.Received)
+			}
+
+			if statsd != nil {
+				statsd.Observe(ping)
+			}
+
+			if metrics != nil {
+				metrics.Observe(ping)
+				metrics.Jitter.WithLabelValues(ping.Hostname).Set(jitter.Jitter().Seconds())
+			}
+
+			if marker != "" {
+				if ping.Marker == marker {
+					matched++
+				} else {
+					mismatched++
+					log.Warn().Str("expected", marker).Str("received", ping.Marker).Str("hostname", ping.Hostname).Uint64("sequence", ping.Sequence).Msg("probe marker mismatch")
+				}
+			}
+
+			if db != nil {
+				if err = db.Write(ping); err != nil {
+					log.Error().Err(err).Msg("could not write ping to sqlite")
+				}
+			}
+
+			if results != nil {
+				if err = results.Write(ping); err != nil {
+					log.Error().Err(err).Msg("could not write ping to results file")
+				}
+			}
+
+			if capture != nil {
+				if err = sonar.WriteFrame(capture, ping); err != nil {
+					log.Error().Err(err).Msg("could not write ping to capture file")
+				}
+			}
+
+			if ping.Farewell {
+				log.Info().Str("hostname", ping.Hostname).Str("ipaddr", ping.IPAddress).Uint64("sequence", ping.Sequence).Msg("sender left cleanly")
+				if idle.Farewell(ping.Hostname) && timeout > 0 {
+					log.Info().Int("senders", idle.Left()).Msg("all senders left, idle timeout suspended until a ping is received")
+				}
+			}
+
+			if order != nil {
+				if ordered, behind := order.Check(ping); !ordered {
+					log.Warn().Str("hostname", ping.Hostname).Uint64("sequence", ping.Sequence).Dur("behind", behind).Uint64("reordered", order.Reordered).Msg("ping timestamp went backwards")
+				}
+			}
+
+			// The ping is acked once it has been handled so that it is not redelivered.
+			ack()
+			if format == "json" {
+				var data []byte
+				if data, err = ping.MarshalJSON(); err != nil {
+					log.Error().Err(err).Msg("could not marshal ping as json")
+					continue
+				}
+				fmt.Fprintln(out, string(data))
+			} else {
+				fmt.Fprintln(out, ping.String())
+			}
+		}
+	}
+}
+
+func replay(c *cli.Context) (err error) {
+	var topic string
+	if topic, err = singleTopic(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// Without a rate the pings are replayed with their captured inter-arrival times.
+	var hz float64
+	if rate := c.String("rate"); rate != "" {
+		if hz, err = sonar.ParseRate(rate); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	var f *os.File
+	if f, err = os.Open(c.String("file")); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer f.Close()
+
+	var seal *sonar.Cipher
+	if seal, err = cipherFrom(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var topicID string
+	if topicID, err = resolveTopic(c.Context, topic, c.Duration("topic-ready-timeout"), true); err != nil {
+		return cli.Exit(err, 1)
+	}
+	log.Info().Str("topic", topic).Str("file", c.String("file")).Float64("hz", hz).Msg("replaying pings")
+
+	var (
+		replayed, failed uint64
+		previous         time.Time
+	)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	r := bufio.NewReader(f)
+replay:
+	for {
+		var ping *sonar.Ping
+		if ping, err = sonar.ReadFrame(r); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return cli.Exit(fmt.Errorf("could not read capture after %d pings: %w", replayed+failed, err), 1)
+		}
+
+		var delay time.Duration
+		switch {
+		case c.String("rate") != "":
+			if hz > 0 && replayed+failed > 0 {
+				delay = time.Duration(float64(time.Second) / hz)
+			}
+		case !previous.IsZero():
+			delay = ping.Received.Sub(previous)
+		}
+		previous = ping.Received
+
+		timer.Reset(delay)
+		select {
+		case <-c.Context.Done():
+			break replay
+		case <-timer.C:
+		}
+
+		// Pings are stamped with the time they are replayed so that listeners measure the
+		// latency of the replay rather than the age of the capture.
+		ping.Timestamp = time.Now()
+
+		var event *ensign.Event
+		if event, err = ping.Event(sonar.MsgPackCodec{}); err == nil && seal != nil {
+			err = seal.Seal(event)
+		}
+
+		if err == nil {
+			err = client.Publish(topicID, event)
+		}
+
+		if err != nil {
+			failed++
+			log.Error().Err(err).Uint64("sequence", ping.Sequence).Str("hostname", ping.Hostname).Msg("could not replay ping")
+			continue
+		}
+		replayed++
+	}
+
+	fmt.Printf("--- %s replay statistics ---\n%d pings replayed from %s, %d failed\n", topic, replayed, c.String("file"), failed)
+	return nil
+}
+
+// Print the ping statistics summary for the topic.
+func printSummary(w io.Writer, topic string, stats *sonar.Stats) {
+	fmt.Fprintf(w, "--- %s sonar statistics ---\n%s\n", topic, stats.Summary())
+}
+
+// Settle an event that was delivered but not handled with the shutdown disposition;
+// nacked events may be delivered again to any consumer.
+func settle(event *ensign.Event, disposition string) {
+	if disposition == "ack" {
+		event.Ack()
+		return
+	}
+	event.Nack(api.Nack_DELIVER_AGAIN_ANY)
+}
+
+// Settle the events already buffered by the subscription without waiting for more to be
+// delivered, returning the number of events settled.
+func drain(sub *ensign.Subscription, disposition string) (settled int) {
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return settled
+			}
+			settle(event, disposition)
+			settled++
+		default:
+			return settled
+		}
+	}
+}
+
+// Parse a semantic version string such as 1.2.3 into the ping schema type.
+func parseSchemaVersion(version string) (_ *api.Type, err error) {
+	schema := &api.Type{Name: sonar.SchemaName}
+	if _, err = fmt.Sscanf(strings.TrimPrefix(version, "v"), "%d.%d.%d", &schema.MajorVersion, &schema.MinorVersion, &schema.PatchVersion); err != nil {
+		return nil, fmt.Errorf("could not parse schema version %q: expected major.minor.patch", version)
+	}
+	return schema, nil
+}
+
+// Parse key=value metadata pairs, rejecting pairs without an equals sign or key.
+func parseMeta(pairs []string) (meta map[string]string, err error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	meta = make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("could not parse metadata %q: specify as key=value", pair)
 		}
+		meta[key] = value
 	}
+	return meta, nil
 }
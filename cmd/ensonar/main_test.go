@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	"github.com/bbengfort/ensign-sonar/sonartest"
+	"github.com/rotationalio/go-ensign"
+	mimetype "github.com/rotationalio/go-ensign/mimetype/v1beta1"
+	"github.com/urfave/cli/v2"
+)
+
+// Runs the command line app with the arguments, returning its output. Exit errors are
+// returned rather than exiting the test process.
+func run(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	app.ExitErrHandler = func(*cli.Context, error) {}
+
+	err := app.Run(append([]string{"ensonar", "--verbosity", "error"}, args...))
+	return out.String(), err
+}
+
+// A command line app run in a go routine by start.
+type running struct {
+	out    bytes.Buffer // stdout, only read once the command has returned
+	errOut bytes.Buffer // stderr, only read once the command has returned
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// Starts the command line app with the arguments in a go routine, connected to the
+// broker rather than to ensign: the global client is connected to the broker and the
+// connect and disconnect hooks of the commands are not run.
+func start(ctx context.Context, t *testing.T, broker *sonartest.Broker, args ...string) *running {
+	t.Helper()
+
+	// The flags must not be set from the environment the tests are run in; Setenv
+	// restores the variables when the test is complete.
+	for _, key := range []string{"ENSIGN_SONAR_TOPIC", "ENSIGN_SONAR_TOKEN"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	var err error
+	if client, err = broker.Client(); err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+
+	conn := client
+	t.Cleanup(func() {
+		conn.Close()
+		client = nil
+	})
+
+	r := &running{done: make(chan error, 1)}
+	app := newApp()
+	app.Writer, app.ErrWriter = &r.out, &r.errOut
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	for _, cmd := range app.Commands {
+		cmd.Before, cmd.After = nil, nil
+	}
+
+	ctx, r.cancel = context.WithCancel(ctx)
+	args = append([]string{"ensonar", "--verbosity", "error"}, args...)
+	go func() { r.done <- app.RunContext(ctx, args) }()
+	return r
+}
+
+// Starts the listen command with the arguments and waits for it to subscribe.
+func listenTo(t *testing.T, broker *sonartest.Broker, args ...string) *running {
+	t.Helper()
+	r := start(context.Background(), t, broker, append([]string{"listen"}, args...)...)
+	eventually(t, "the listener to subscribe", func() bool { return broker.Subscribers() == 1 })
+	return r
+}
+
+// Wait for the command to return, returning its output.
+func (r *running) Wait(t *testing.T) (stdout, stderr string, err error) {
+	t.Helper()
+	select {
+	case err = <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the command to return")
+	}
+	return r.out.String(), r.errOut.String(), err
+}
+
+// Stop the command as if it were interrupted and wait for it to return.
+func (r *running) Stop(t *testing.T) (stdout, stderr string, err error) {
+	t.Helper()
+	r.cancel()
+	return r.Wait(t)
+}
+
+// Publishes the events to the topic as a sender would, waiting for the broker to
+// route them.
+func publish(t *testing.T, broker *sonartest.Broker, topic string, events ...*ensign.Event) {
+	t.Helper()
+	sender, err := broker.Client()
+	if err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+	defer sender.Close()
+
+	published := broker.Published()
+	for _, event := range events {
+		if err = sender.Publish(topic, event); err != nil {
+			t.Fatalf("could not publish event: %s", err)
+		}
+	}
+
+	expected := published + uint64(len(events))
+	eventually(t, "the events to be published", func() bool { return broker.Published() == expected })
+}
+
+// Publishes the pings to the topic encoded with msgpack.
+func publishPings(t *testing.T, broker *sonartest.Broker, topic string, pings ...*sonar.Ping) {
+	t.Helper()
+	events := make([]*ensign.Event, 0, len(pings))
+	for _, ping := range pings {
+		event, err := ping.Event(sonar.MsgPackCodec{})
+		if err != nil {
+			t.Fatalf("could not create event: %s", err)
+		}
+		events = append(events, event)
+	}
+	publish(t, broker, topic, events...)
+}
+
+// Waits for the broker to have received an ack or nack for every published event so
+// that the listener can be stopped without closing its subscription while events are
+// being delivered.
+func settled(t *testing.T, broker *sonartest.Broker) {
+	t.Helper()
+	eventually(t, "the events to be settled", func() bool { return broker.Acked()+broker.Nacked() == broker.Published() })
+}
+
+// Waits for the condition to be true, failing the test if it is not within a second.
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		disposition   string
+		acked, nacked uint64
+	}{
+		{"ack", 1, 0},
+		{"nack", 0, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.disposition, func(t *testing.T) {
+			broker := sonartest.New(sonartest.WithTopics("pings"))
+			defer broker.Close()
+
+			client, err := broker.Client()
+			if err != nil {
+				t.Fatalf("could not connect to broker: %s", err)
+			}
+			defer client.Close()
+
+			var sub *ensign.Subscription
+			if sub, err = client.Subscribe("pings"); err != nil {
+				t.Fatalf("could not subscribe: %s", err)
+			}
+			defer sub.Close()
+
+			ping := sonar.New().Next()
+			defer ping.Release()
+
+			var event *ensign.Event
+			if event, err = ping.Event(sonar.MsgPackCodec{}); err != nil {
+				t.Fatalf("could not create event: %s", err)
+			}
+
+			if err = client.Publish("pings", event); err != nil {
+				t.Fatalf("could not publish ping: %s", err)
+			}
+
+			// The event is buffered by the subscription but not received by the listener.
+			eventually(t, "the event to be buffered", func() bool { return len(sub.C) == 1 })
+			if settled := drain(sub, tc.disposition); settled != 1 {
+				t.Fatalf("expected 1 buffered event to be settled, settled %d", settled)
+			}
+
+			if settled := drain(sub, tc.disposition); settled != 0 {
+				t.Errorf("expected no events to be settled once drained, settled %d", settled)
+			}
+
+			eventually(t, "the event to be settled", func() bool { return broker.Acked()+broker.Nacked() == 1 })
+			if broker.Acked() != tc.acked || broker.Nacked() != tc.nacked {
+				t.Errorf("expected %d acked and %d nacked, got %d acked and %d nacked", tc.acked, tc.nacked, broker.Acked(), broker.Nacked())
+			}
+		})
+	}
+}
+
+func TestParseSchemaVersion(t *testing.T) {
+	tests := []struct {
+		version             string
+		major, minor, patch uint32
+		valid               bool
+	}{
+		{"1.2.3", 1, 2, 3, true},
+		{"v1.2.3", 1, 2, 3, true},
+		{"0.0.0", 0, 0, 0, true},
+		{"10.20.30", 10, 20, 30, true},
+		{"", 0, 0, 0, false},
+		{"1.2", 0, 0, 0, false},
+		{"1", 0, 0, 0, false},
+		{"a.b.c", 0, 0, 0, false},
+		{"vv1.2.3", 0, 0, 0, false},
+		{"-1.2.3", 0, 0, 0, false},
+	}
+
+	for _, tc := range tests {
+		schema, err := parseSchemaVersion(tc.version)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("expected an error parsing %q, got %s", tc.version, schema.Version())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("could not parse %q: %s", tc.version, err)
+			continue
+		}
+
+		if schema.Name != sonar.SchemaName || schema.MajorVersion != tc.major || schema.MinorVersion != tc.minor || schema.PatchVersion != tc.patch {
+			t.Errorf("expected %q to be parsed as %s v%d.%d.%d, got %s %s", tc.version, sonar.SchemaName, tc.major, tc.minor, tc.patch, schema.Name, schema.Version())
+		}
+	}
+}
+
+func TestListenRequireVersion(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	version := fmt.Sprintf("%d.%d.%d", sonar.VersionMajor, sonar.VersionMinor, sonar.VersionPatch)
+	listener := listenTo(t, broker, "--require-version", version)
+
+	pings := sonar.New()
+	publishPings(t, broker, "sonar.ping", pings.Next(), pings.Next())
+	settled(t, broker)
+
+	out, _, err := listener.Stop(t)
+	if err != nil {
+		t.Fatalf("listener stopped with an error: %s", err)
+	}
+
+	if broker.Acked() != 2 || !strings.Contains(out, "2 pings transmitted, 2 received") {
+		t.Errorf("expected pings with the required version to be handled, got %d acked:\n%s", broker.Acked(), out)
+	}
+}
+
+func TestListenSchemaMismatch(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	listener := listenTo(t, broker, "--require-version", "9.9.9")
+	publishPings(t, broker, "sonar.ping", sonar.New().Next())
+
+	_, _, err := listener.Wait(t)
+	if err == nil || !strings.Contains(err.Error(), "require ping v9.9.9") {
+		t.Fatalf("expected the listener to exit with a schema mismatch, got %v", err)
+	}
+
+	var exit cli.ExitCoder
+	if !errors.As(err, &exit) || exit.ExitCode() != 1 {
+		t.Errorf("expected the listener to exit with code 1, got %v", err)
+	}
+
+	// The mismatched ping is settled with the default shutdown disposition.
+	eventually(t, "the ping to be nacked", func() bool { return broker.Nacked() == 1 })
+	if broker.Acked() != 0 {
+		t.Errorf("expected the mismatched ping not to be acked, got %d acked", broker.Acked())
+	}
+}
+
+func TestListenUnknownMimetype(t *testing.T) {
+	tests := []struct {
+		policy        string
+		acked, nacked uint64
+	}{
+		{"ack", 1, 0},
+		{"nack", 0, 1},
+		{"NACK", 0, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+			defer broker.Close()
+
+			listener := listenTo(t, broker, "--unknown-mimetype", tc.policy)
+			publish(t, broker, "sonar.ping", &ensign.Event{Data: []byte("not a ping"), Mimetype: mimetype.TextPlain})
+			settled(t, broker)
+
+			out, _, err := listener.Stop(t)
+			if err != nil {
+				t.Fatalf("listener stopped with an error: %s", err)
+			}
+
+			if broker.Acked() != tc.acked || broker.Nacked() != tc.nacked {
+				t.Errorf("expected %d acked and %d nacked, got %d acked and %d nacked", tc.acked, tc.nacked, broker.Acked(), broker.Nacked())
+			}
+
+			// Events with an unknown mimetype are skipped rather than counted as pings.
+			if !strings.Contains(out, "0 pings received") {
+				t.Errorf("expected no pings to be received:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestListenUnknownMimetypePolicy(t *testing.T) {
+	// Dead letter queues are recognized but not supported by the ensign client.
+	tests := map[string]string{
+		"dlq":    "dead letter queues are not supported",
+		"ignore": `unknown mimetype policy "ignore"`,
+	}
+
+	for policy, expected := range tests {
+		broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+		_, _, err := start(context.Background(), t, broker, "listen", "--unknown-mimetype", policy).Wait(t)
+		broker.Close()
+
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected the %s policy to be rejected with %q, got %v", policy, expected, err)
+		}
+
+		if broker.Subscribers() != 0 {
+			t.Errorf("expected the listener not to subscribe with the %s policy", policy)
+		}
+	}
+}
+
+func TestListenMarker(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	listener := listenTo(t, broker, "--marker", "canary")
+
+	// Mismatched pings are still handled, the marker is only validated.
+	canary, other := sonar.New(sonar.WithHostname("canary"), sonar.WithMarker("canary")), sonar.New(sonar.WithHostname("other"), sonar.WithMarker("other"))
+	publishPings(t, broker, "sonar.ping", canary.Next(), other.Next(), canary.Next(), sonar.New(sonar.WithHostname("none")).Next())
+	settled(t, broker)
+
+	out, _, err := listener.Stop(t)
+	if err != nil {
+		t.Fatalf("listener stopped with an error: %s", err)
+	}
+
+	if broker.Acked() != 4 {
+		t.Errorf("expected all 4 pings to be acked, got %d", broker.Acked())
+	}
+
+	if !strings.Contains(out, "2 pings matched the probe marker, 2 mismatched") {
+		t.Errorf("expected 2 matched and 2 mismatched pings:\n%s", out)
+	}
+}
+
+func TestListenIdleTimeout(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	listener := listenTo(t, broker, "--idle-timeout", "100ms")
+	publishPings(t, broker, "sonar.ping", sonar.New().Next())
+
+	_, _, err := listener.Wait(t)
+	if err == nil || err.Error() != "idle timeout: no pings received in 100ms" {
+		t.Fatalf("expected the listener to exit with the idle timeout, got %v", err)
+	}
+
+	var exit cli.ExitCoder
+	if !errors.As(err, &exit) || exit.ExitCode() != 1 {
+		t.Errorf("expected the listener to exit with code 1, got %v", err)
+	}
+
+	if broker.Acked() != 1 {
+		t.Errorf("expected the ping received before the timeout to be acked, got %d acked", broker.Acked())
+	}
+}
+
+func TestListenIdleTimeoutFarewell(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	listener := listenTo(t, broker, "--idle-timeout", "100ms")
+	pings := sonar.New()
+	publishPings(t, broker, "sonar.ping", pings.Next(), pings.Farewell())
+	settled(t, broker)
+
+	// The listener does not time out once the only sender has left.
+	select {
+	case err := <-listener.done:
+		t.Fatalf("expected the idle timeout to be suspended after the farewell, listener returned %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	out, _, err := listener.Stop(t)
+	if err != nil {
+		t.Fatalf("listener stopped with an error: %s", err)
+	}
+
+	if !strings.Contains(out, "1 senders left cleanly") {
+		t.Errorf("expected the sender to have left cleanly:\n%s", out)
+	}
+}
+
+func TestListenToken(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	listener := start(context.Background(), t, broker, "--token", "run1", "listen")
+	eventually(t, "the listener to subscribe", func() bool { return broker.Subscribers() == 1 })
+
+	run1, run2, untagged := sonar.New(sonar.WithToken("run1")), sonar.New(sonar.WithToken("run2")), sonar.New()
+	publishPings(t, broker, "sonar.ping", run1.Next(), run2.Next(), untagged.Next(), run1.Next(), run2.Next())
+	settled(t, broker)
+
+	out, _, err := listener.Stop(t)
+	if err != nil {
+		t.Fatalf("listener stopped with an error: %s", err)
+	}
+
+	// Pings from other runs are acked so that they are not redelivered, but not counted.
+	if broker.Acked() != 5 || broker.Nacked() != 0 {
+		t.Errorf("expected all 5 pings to be acked, got %d acked and %d nacked", broker.Acked(), broker.Nacked())
+	}
+
+	if !strings.Contains(out, "2 pings transmitted, 2 received, 0.0% loss") {
+		t.Errorf("expected only the 2 pings from run1 to be received:\n%s", out)
+	}
+
+	if printed := strings.Count(out, " bytes from "); printed != 2 {
+		t.Errorf("expected 2 pings to be printed, got %d:\n%s", printed, out)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.pong", "sonar.ping"))
+	defer broker.Close()
+
+	pings := sonar.New()
+	publishPings(t, broker, "sonar.ping", pings.Next(), pings.Next(), pings.Next())
+
+	out, _, err := start(context.Background(), t, broker, "topics").Wait(t)
+	if err != nil {
+		t.Fatalf("could not list topics: %s", err)
+	}
+
+	// The columns are aligned with spaces, so the fields of each line are compared.
+	expected := [][]string{
+		{"NAME", "ID", "OFFSET", "SHARDS", "READONLY"},
+		{"sonar.ping", broker.Topic("sonar.ping"), "3", "1", "false"},
+		{"sonar.pong", broker.Topic("sonar.pong"), "0", "1", "false"},
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected a header and 2 topics, got:\n%s", out)
+	}
+
+	for i, line := range lines {
+		if fields := strings.Fields(line); strings.Join(fields, " ") != strings.Join(expected[i], " ") {
+			t.Errorf("expected line %d to be %q, got %q", i, expected[i], fields)
+		}
+	}
+
+	// The columns are aligned, so every field starts at the same offset on every line.
+	if id := strings.Index(lines[0], "ID"); strings.Index(lines[1], broker.Topic("sonar.ping")) != id || strings.Index(lines[2], broker.Topic("sonar.pong")) != id {
+		t.Errorf("expected the topic ids to be aligned with the header:\n%s", out)
+	}
+}
+
+func TestTopicsJSON(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+	publishPings(t, broker, "sonar.ping", sonar.New().Next())
+
+	out, _, err := start(context.Background(), t, broker, "topics", "--format", "json").Wait(t)
+	if err != nil {
+		t.Fatalf("could not list topics: %s", err)
+	}
+
+	var topics []map[string]interface{}
+	if err = json.Unmarshal([]byte(out), &topics); err != nil {
+		t.Fatalf("could not parse topics json: %s\n%s", err, out)
+	}
+
+	if len(topics) != 1 {
+		t.Fatalf("expected 1 topic, got %d", len(topics))
+	}
+
+	topic := topics[0]
+	if topic["name"] != "sonar.ping" || topic["id"] != broker.Topic("sonar.ping") || topic["offset"] != 1.0 || topic["shards"] != 1.0 || topic["readonly"] != false {
+		t.Errorf("unexpected topic %v", topic)
+	}
+
+	var created time.Time
+	if created, err = time.Parse(time.RFC3339Nano, topic["created"].(string)); err != nil || time.Since(created) > time.Minute {
+		t.Errorf("expected the topic to have been created recently, got %v", topic["created"])
+	}
+
+	if _, _, err = start(context.Background(), t, broker, "topics", "--format", "yaml").Wait(t); err == nil || !strings.Contains(err.Error(), `unknown output format "yaml"`) {
+		t.Errorf("expected an unknown format to be rejected, got %v", err)
+	}
+}
+
+func TestResolveTopicLate(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"), sonartest.WithTopicDelay(200*time.Millisecond))
+	defer broker.Close()
+
+	var err error
+	if client, err = broker.Client(); err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+	defer func() {
+		client.Close()
+		client = nil
+	}()
+
+	// The created topic does not exist until the topic delay has passed.
+	started := time.Now()
+	topicID, err := resolveTopic(context.Background(), "sonar.pong", 5*time.Second, true)
+	if err != nil {
+		t.Fatalf("could not resolve topic: %s", err)
+	}
+
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond {
+		t.Errorf("expected to wait for the topic to be ready, returned after %s", elapsed)
+	}
+
+	if topicID != broker.Topic("sonar.pong") {
+		t.Errorf("expected the created topic id %s, got %s", broker.Topic("sonar.pong"), topicID)
+	}
+
+	// A topic that is not ready within the timeout is an error.
+	if _, err = resolveTopic(context.Background(), "sonar.late", 50*time.Millisecond, true); err == nil || err.Error() != `topic "sonar.late" was not ready after 50ms` {
+		t.Errorf("expected the topic not to be ready in time, got %v", err)
+	}
+
+	if _, err = resolveTopic(context.Background(), "sonar.missing", time.Second, false); err == nil || !strings.Contains(err.Error(), "topic creation is disabled") {
+		t.Errorf("expected a missing topic not to be created, got %v", err)
+	}
+}
+
+func TestListenFrom(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	listener := listenTo(t, broker, "--from", "alpha*, 192.0.2.1")
+
+	alpha := sonar.New(sonar.WithHostname("alpha-1"), sonar.WithIPAddress("198.51.100.1"))
+	bravo := sonar.New(sonar.WithHostname("bravo"), sonar.WithIPAddress("192.0.2.1"))
+	other := sonar.New(sonar.WithHostname("charlie"), sonar.WithIPAddress("198.51.100.3"))
+	publishPings(t, broker, "sonar.ping", alpha.Next(), bravo.Next(), other.Next(), other.Next())
+	settled(t, broker)
+
+	out, _, err := listener.Stop(t)
+	if err != nil {
+		t.Fatalf("listener stopped with an error: %s", err)
+	}
+
+	// Pings from other senders are nacked so that other consumers can receive them.
+	if broker.Acked() != 2 || broker.Nacked() != 2 {
+		t.Errorf("expected 2 acked and 2 nacked, got %d acked and %d nacked", broker.Acked(), broker.Nacked())
+	}
+
+	if !strings.Contains(out, "2 pings transmitted, 2 received") {
+		t.Errorf("expected only the matching pings to be received:\n%s", out)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+var resultsHeader = []string{"sequence", "hostname", "ipaddr", "timestamp", "received", "timedelta_ms", "nbytes", "expired"}
+
+// Writes one record per received ping to a results file for later analysis; the format
+// is chosen by the file extension: .csv for CSV with a header row, or .json for JSON
+// lines encoded by Ping.MarshalJSON. Writes are buffered until the writer is closed.
+type resultsWriter struct {
+	f    *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer
+	json bool
+}
+
+func openResults(path string) (w *resultsWriter, err error) {
+	w = &resultsWriter{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+	case ".json", ".jsonl":
+		w.json = true
+	default:
+		return nil, fmt.Errorf("unknown results format %q: use a .csv or .json file", ext)
+	}
+
+	if w.f, err = os.Create(path); err != nil {
+		return nil, err
+	}
+	w.buf = bufio.NewWriter(w.f)
+
+	if !w.json {
+		w.csv = csv.NewWriter(w.buf)
+		if err = w.csv.Write(resultsHeader); err != nil {
+			w.f.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *resultsWriter) Write(ping *sonar.Ping) (err error) {
+	if w.json {
+		var data []byte
+		if data, err = ping.MarshalJSON(); err != nil {
+			return err
+		}
+
+		if _, err = w.buf.Write(data); err != nil {
+			return err
+		}
+		return w.buf.WriteByte('\n')
+	}
+
+	return w.csv.Write([]string{
+		strconv.FormatUint(ping.Sequence, 10),
+		ping.Hostname,
+		ping.IPAddress,
+		ping.Timestamp.Format(time.RFC3339Nano),
+		ping.Received.Format(time.RFC3339Nano),
+		strconv.FormatFloat(milliseconds(ping.Timedelta()), 'f', -1, 64),
+		strconv.Itoa(ping.Size()),
+		strconv.FormatBool(ping.Expired()),
+	})
+}
+
+// Close flushes the buffered records and closes the file.
+func (w *resultsWriter) Close() (err error) {
+	if w.csv != nil {
+		w.csv.Flush()
+		err = w.csv.Error()
+	}
+
+	if ferr := w.buf.Flush(); err == nil {
+		err = ferr
+	}
+
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
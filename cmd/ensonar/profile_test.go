@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestProfilePings(t *testing.T) {
+	result, err := profilePings(1000, "token")
+	if err != nil {
+		t.Fatalf("could not profile pings: %s", err)
+	}
+
+	// The bounds are loose so that the test passes with the race detector enabled.
+	if ns := result.NsPerOp(); ns <= 0 || ns > 1e6 {
+		t.Errorf("expected between 0 and 1ms per ping, got %d ns/op", ns)
+	}
+
+	if result.BytesPerOp == 0 || result.BytesPerOp > 1<<16 {
+		t.Errorf("expected between 0 and 64KiB allocated per ping, got %d B/op", result.BytesPerOp)
+	}
+
+	if result.AllocsPerOp == 0 || result.AllocsPerOp > 1000 {
+		t.Errorf("expected between 0 and 1000 allocations per ping, got %d allocs/op", result.AllocsPerOp)
+	}
+
+	expected := fmt.Sprintf("BenchmarkPingEvent\t1000\t%d ns/op\t%d B/op\t%d allocs/op", result.NsPerOp(), result.BytesPerOp, result.AllocsPerOp)
+	if s := result.String(); s != expected {
+		t.Errorf("expected benchmark output %q, got %q", expected, s)
+	}
+}
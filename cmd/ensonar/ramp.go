@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	rampWindow         = time.Second
+	rampErrorThreshold = 0.01 // fraction of pings in a window not acked that breaks the ramp
+)
+
+// Linearly increases the publish rate from a start rate to an end rate over a duration
+// to find the rate at which the broker stops keeping up. The sent and acked counts are
+// sampled in windows; the peak sustained rate is the highest ack throughput achieved
+// in a window before the fraction of pings sent in a window that were not acked in it
+// first crossed the threshold.
+type ramp struct {
+	from, to float64
+	duration time.Duration
+	started  time.Time
+	window   time.Time
+	sent     uint64 // cumulative sent at the start of the window
+	acked    uint64 // cumulative acked at the start of the window
+	peak     float64
+	broken   bool
+	reported bool
+}
+
+func newRamp(from, to float64, duration time.Duration) *ramp {
+	return &ramp{from: from, to: to, duration: duration}
+}
+
+// Start the ramp at the specified time.
+func (r *ramp) Start(now time.Time) {
+	r.started, r.window = now, now
+}
+
+// Rate returns the publish rate in pings per second at the specified time; once the
+// ramp is complete the rate remains at the end rate.
+func (r *ramp) Rate(now time.Time) float64 {
+	progress := float64(now.Sub(r.started)) / float64(r.duration)
+	if progress >= 1 {
+		return r.to
+	}
+	return r.from + (r.to-r.from)*progress
+}
+
+// Update the ramp with the cumulative number of pings sent and acked by the broker.
+// Acks lag behind publishes, so a window is only behind if fewer pings were acked in it
+// than were sent, i.e. the pings awaiting an ack are growing.
+func (r *ramp) Update(now time.Time, sent, acked uint64) {
+	if elapsed := now.Sub(r.window); elapsed >= rampWindow {
+		if dsent := sent - r.sent; dsent > 0 && !r.broken {
+			dacked := acked - r.acked
+			if behind := (float64(dsent) - float64(dacked)) / float64(dsent); behind > rampErrorThreshold {
+				r.broken = true
+				log.Warn().Float64("rate", r.Rate(now)).Float64("unacked", behind).Msg("acks stopped keeping up with the publish rate")
+			} else if achieved := float64(dacked) / elapsed.Seconds(); achieved > r.peak {
+				r.peak = achieved
+			}
+		}
+		r.window, r.sent, r.acked = now, sent, acked
+	}
+
+	if !r.reported && now.Sub(r.started) >= r.duration {
+		r.Report()
+	}
+}
+
+// Report logs the peak sustained rate once, either at the end of the ramp or when the
+// run ends before the ramp is complete.
+func (r *ramp) Report() {
+	if r.reported {
+		return
+	}
+	r.reported = true
+	log.Info().Float64("from", r.from).Float64("to", r.to).Dur("duration", r.duration).Float64("peak", r.peak).Bool("broken", r.broken).Msg("ramp complete: peak sustained ack rate")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	"github.com/rotationalio/go-ensign"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	reconnectThreshold   = 5 // consecutive publish errors before reconnecting
+	reconnectBackoffBase = 100 * time.Millisecond
+)
+
+// Recreates the global ensign client when publishes fail repeatedly, e.g. when the
+// broker blips, rather than continuing to publish on a dead connection. Reconnect
+// attempts are delayed with a capped, jittered exponential backoff that is only reset
+// once a publish succeeds, so a connection that is established but still failing does
+// not reconnect in a tight loop.
+type reconnector struct {
+	opts     []ensign.Option
+	backoff  *sonar.Backoff
+	failures int
+}
+
+func newReconnector(opts []ensign.Option, maxRetries int, backoffMax time.Duration) *reconnector {
+	return &reconnector{
+		opts:    opts,
+		backoff: sonar.NewBackoff(reconnectBackoffBase, backoffMax, maxRetries, nil),
+	}
+}
+
+// Success resets the consecutive failures and the backoff after a publish succeeds.
+func (r *reconnector) Success() {
+	r.failures = 0
+	r.backoff.Reset()
+}
+
+// Failure records a publish error and reconnects the client once the threshold of
+// consecutive errors is reached. An error is returned if the client could not be
+// reconnected within the maximum number of retries.
+func (r *reconnector) Failure(ctx context.Context) (err error) {
+	if r.failures++; r.failures < reconnectThreshold {
+		return nil
+	}
+
+	for {
+		if err = r.backoff.Wait(ctx); err != nil {
+			return fmt.Errorf("could not reconnect to ensign after %d attempts: %w", r.backoff.Attempts(), err)
+		}
+
+		log.Warn().Int("failures", r.failures).Int("attempt", r.backoff.Attempts()).Msg("reconnecting to ensign")
+
+		// The connection is already broken so errors closing it are not actionable.
+		client.Close()
+
+		var reconnected *ensign.Client
+		if reconnected, err = ensign.New(r.opts...); err != nil {
+			log.Error().Err(err).Msg("could not reconnect to ensign")
+			continue
+		}
+
+		client = reconnected
+		r.failures = 0
+		return nil
+	}
+}
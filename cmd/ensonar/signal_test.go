@@ -0,0 +1,80 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	"github.com/bbengfort/ensign-sonar/sonartest"
+	"github.com/urfave/cli/v2"
+)
+
+func TestListenSIGTERM(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("sonar.ping"))
+	defer broker.Close()
+
+	var err error
+	if client, err = broker.Client(); err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+	defer func() { client = nil }()
+
+	// The disconnect hook is run as it would be by main, which closes the client.
+	var (
+		out          bytes.Buffer
+		disconnected bool
+	)
+	app := newApp()
+	app.Writer = &out
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	for _, cmd := range app.Commands {
+		if cmd.Name == "listen" {
+			cmd.Before = nil
+			cmd.After = func(c *cli.Context) error {
+				disconnected = true
+				return disconnect(c)
+			}
+		}
+	}
+
+	// The signal is caught by the context so it does not terminate the test process.
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() { done <- app.RunContext(ctx, []string{"ensonar", "--verbosity", "error", "listen"}) }()
+	eventually(t, "the listener to subscribe", func() bool { return broker.Subscribers() == 1 })
+
+	publishPings(t, broker, "sonar.ping", sonar.New().Next())
+	settled(t, broker)
+
+	if err = syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("could not send SIGTERM: %s", err)
+	}
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the listener to shut down after SIGTERM")
+	}
+
+	if err != nil {
+		t.Fatalf("expected the listener to shut down gracefully, got %s", err)
+	}
+
+	if !disconnected {
+		t.Error("expected the disconnect hook to run after SIGTERM")
+	}
+
+	if !strings.Contains(out.String(), "1 pings transmitted, 1 received, 0.0% loss") {
+		t.Errorf("expected the summary to be printed after SIGTERM:\n%s", out.String())
+	}
+}
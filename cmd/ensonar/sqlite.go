@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	sqliteBatchSize     = 500
+	sqliteBatchInterval = time.Second
+)
+
+const createPingsTable = `CREATE TABLE IF NOT EXISTS pings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sequence INTEGER NOT NULL,
+	hostname TEXT,
+	ipaddr TEXT,
+	token TEXT,
+	ttl_ms REAL,
+	timestamp DATETIME NOT NULL,
+	received DATETIME NOT NULL,
+	latency_ms REAL,
+	nbytes INTEGER
+)`
+
+const insertPing = `INSERT INTO pings (sequence, hostname, ipaddr, token, ttl_ms, timestamp, received, latency_ms, nbytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// Writes received pings to a SQLite database for offline analysis. Inserts are made in
+// batched transactions that are committed when the batch is full; the caller should
+// also Commit every sqliteBatchInterval so that the database stays current on slow
+// streams, since no pings may be written for a long time.
+type sqliteWriter struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	pending int
+}
+
+func openSQLite(path string) (w *sqliteWriter, err error) {
+	w = &sqliteWriter{}
+	if w.db, err = sql.Open("sqlite3", path); err != nil {
+		return nil, err
+	}
+
+	if _, err = w.db.Exec(createPingsTable); err != nil {
+		w.db.Close()
+		return nil, err
+	}
+
+	if w.stmt, err = w.db.Prepare(insertPing); err != nil {
+		w.db.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *sqliteWriter) Write(ping *sonar.Ping) (err error) {
+	if w.tx == nil {
+		if w.tx, err = w.db.Begin(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = w.tx.Stmt(w.stmt).Exec(
+		ping.Sequence, ping.Hostname, ping.IPAddress, ping.Token,
+		milliseconds(ping.TTL), ping.Timestamp, ping.Received,
+		milliseconds(ping.Timedelta()), ping.Size(),
+	); err != nil {
+		return err
+	}
+
+	if w.pending++; w.pending >= sqliteBatchSize {
+		return w.Commit()
+	}
+	return nil
+}
+
+func (w *sqliteWriter) Commit() (err error) {
+	if w.tx == nil {
+		return nil
+	}
+
+	err = w.tx.Commit()
+	w.tx = nil
+	w.pending = 0
+	return err
+}
+
+func (w *sqliteWriter) Close() (err error) {
+	if err = w.Commit(); err != nil {
+		w.db.Close()
+		return err
+	}
+
+	w.stmt.Close()
+	return w.db.Close()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
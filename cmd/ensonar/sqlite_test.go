@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pings.db")
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatalf("could not open sqlite database: %s", err)
+	}
+
+	now := time.Now()
+	pings := sonar.New(sonar.WithHostname("alpha"), sonar.WithToken("run1"))
+	for i := 0; i < 3; i++ {
+		ping := pings.Next()
+		ping.Received = ping.Timestamp.Add(5 * time.Millisecond)
+		if err = db.Write(ping); err != nil {
+			t.Fatalf("could not write ping: %s", err)
+		}
+		ping.Release()
+	}
+
+	// The batch is not full, so the pings are committed explicitly as by the listener.
+	if err = db.Commit(); err != nil {
+		t.Fatalf("could not commit pings: %s", err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatalf("could not close sqlite database: %s", err)
+	}
+
+	if db, err = openSQLite(path); err != nil {
+		t.Fatalf("could not reopen sqlite database: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.db.Query("SELECT sequence, hostname, token, latency_ms, timestamp FROM pings ORDER BY id")
+	if err != nil {
+		t.Fatalf("could not query pings: %s", err)
+	}
+	defer rows.Close()
+
+	var sequences []uint64
+	for rows.Next() {
+		var (
+			sequence        uint64
+			hostname, token string
+			latency         float64
+			timestamp       time.Time
+		)
+		if err = rows.Scan(&sequence, &hostname, &token, &latency, &timestamp); err != nil {
+			t.Fatalf("could not scan ping: %s", err)
+		}
+
+		if hostname != "alpha" || token != "run1" {
+			t.Errorf("expected ping from alpha with token run1, got %q with token %q", hostname, token)
+		}
+
+		if latency != 5 {
+			t.Errorf("expected a latency of 5ms, got %0.3fms", latency)
+		}
+
+		if timestamp.Before(now.Add(-time.Second)) || timestamp.After(time.Now()) {
+			t.Errorf("expected the timestamp to be when the ping was sent, got %s", timestamp)
+		}
+		sequences = append(sequences, sequence)
+	}
+
+	if err = rows.Err(); err != nil {
+		t.Fatalf("could not read pings: %s", err)
+	}
+
+	if len(sequences) != 3 || sequences[0] != 1 || sequences[1] != 2 || sequences[2] != 3 {
+		t.Errorf("expected pings 1, 2, and 3 to be read back, got %v", sequences)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+const statusInterval = time.Second
+
+// Renders a single line with the current publish and ack rates, the number of publish
+// errors, and the elapsed time that is rewritten in place every interval as an
+// alternative to the progress dots during long runs. When the renderer is stopped the
+// line is rewritten with the average rates over the whole run.
+type statusLine struct {
+	w         io.Writer
+	pub       *sonar.Publisher
+	acks      *ackTracker
+	started   time.Time
+	last      time.Time
+	published uint64 // published at the last render
+	acked     uint64 // acked at the last render
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newStatusLine(w io.Writer, pub *sonar.Publisher, acks *ackTracker) *statusLine {
+	return &statusLine{
+		w:    w,
+		pub:  pub,
+		acks: acks,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Start rendering the status line every interval in a go routine.
+func (s *statusLine) Start() {
+	s.started = time.Now()
+	s.last = s.started
+	go s.run()
+}
+
+// Stop rendering and write the final status line.
+func (s *statusLine) Stop() {
+	close(s.stop)
+	<-s.done
+
+	now := time.Now()
+	s.last, s.published, s.acked = s.started, 0, 0
+	s.render(now)
+	fmt.Fprintln(s.w, "")
+}
+
+func (s *statusLine) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.render(now)
+		}
+	}
+}
+
+// Render the rates since the last render and update the last render counts.
+func (s *statusLine) render(now time.Time) {
+	published, acked := s.pub.Published(), s.acks.Acked()
+	seconds := now.Sub(s.last).Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	fmt.Fprintf(s.w, "\033[2K\r%s elapsed: %d published (%0.1f/s), %d acked (%0.1f/s), %d errors",
+		now.Sub(s.started).Round(time.Second), published, float64(published-s.published)/seconds,
+		acked, float64(acked-s.acked)/seconds, s.pub.Errors(),
+	)
+	s.last, s.published, s.acked = now, published, acked
+}
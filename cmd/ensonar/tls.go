@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rotationalio/go-ensign"
+	"github.com/rotationalio/go-ensign/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Create the tls configuration to connect to a broker whose certificate is signed by a
+// private CA bundle and/or whose leaf certificate is pinned by its SHA-256 fingerprint.
+// If a fingerprint is pinned without a CA then the certificate chain is not verified
+// and the pin alone is trusted, which supports brokers with self-signed certificates.
+func tlsConfig(caPath, fingerprint string) (conf *tls.Config, err error) {
+	conf = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caPath != "" {
+		var pem []byte
+		if pem, err = os.ReadFile(caPath); err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in %s", caPath)
+		}
+	}
+
+	if fingerprint != "" {
+		var pin []byte
+		if pin, err = parseFingerprint(fingerprint); err != nil {
+			return nil, err
+		}
+
+		conf.InsecureSkipVerify = caPath == ""
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("broker presented no certificates")
+			}
+
+			digest := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(digest[:], pin) {
+				return fmt.Errorf("broker certificate fingerprint %X does not match pinned fingerprint", digest)
+			}
+			return nil
+		}
+	}
+
+	return conf, nil
+}
+
+// Parse a hex encoded SHA-256 fingerprint, optionally separated by colons as printed
+// by openssl x509 -fingerprint -sha256.
+func parseFingerprint(fingerprint string) (pin []byte, err error) {
+	fingerprint = strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", "")
+	if pin, err = hex.DecodeString(fingerprint); err != nil {
+		return nil, fmt.Errorf("could not parse certificate fingerprint: %w", err)
+	}
+
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("certificate fingerprint must be a %d byte SHA-256 digest", sha256.Size)
+	}
+	return pin, nil
+}
+
+// Create the ensign options to connect using the specified tls configuration. Because
+// custom dial options replace the ensign defaults, the authentication interceptors are
+// also created here by logging in with the credentials. The endpoint and credentials
+// are read from the environment if they are empty.
+func tlsOptions(conf *tls.Config, endpoint, clientID, clientSecret string) (_ []ensign.Option, err error) {
+	if endpoint == "" {
+		if endpoint = os.Getenv(ensign.EnvEndpoint); endpoint == "" {
+			endpoint = ensign.EnsignEndpoint
+		}
+	}
+
+	if clientID == "" {
+		clientID = os.Getenv(ensign.EnvClientID)
+	}
+
+	if clientSecret == "" {
+		clientSecret = os.Getenv(ensign.EnvClientSecret)
+	}
+
+	dialing := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(conf))}
+
+	if noauth, _ := strconv.ParseBool(os.Getenv(ensign.EnvNoAuth)); !noauth {
+		authURL := os.Getenv(ensign.EnvAuthURL)
+		if authURL == "" {
+			authURL = ensign.AuthEndpoint
+		}
+
+		var authClient *auth.Client
+		if authClient, err = auth.New(authURL, false); err != nil {
+			return nil, err
+		}
+
+		if _, err = authClient.Login(context.Background(), clientID, clientSecret); err != nil {
+			return nil, err
+		}
+
+		dialing = append(dialing, grpc.WithUnaryInterceptor(authClient.UnaryAuthenticate), grpc.WithStreamInterceptor(authClient.StreamAuthenticate))
+	}
+
+	return []ensign.Option{ensign.WithEnsignEndpoint(endpoint, false, dialing...)}, nil
+}
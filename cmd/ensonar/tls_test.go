@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a self-signed certificate, returning its DER encoding and the path of a PEM
+// encoded CA bundle containing it.
+func selfSigned(t *testing.T) (der []byte, path string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sonar.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+
+	path = filepath.Join(t.TempDir(), "ca.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("could not write CA bundle: %s", err)
+	}
+	return der, path
+}
+
+// Formats the fingerprint as printed by openssl x509 -fingerprint -sha256.
+func opensslFingerprint(der []byte) string {
+	digest := sha256.Sum256(der)
+	pairs := make([]string, len(digest))
+	for i, b := range digest {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
+
+func TestParseFingerprint(t *testing.T) {
+	der, _ := selfSigned(t)
+	digest := sha256.Sum256(der)
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		valid       bool
+	}{
+		{"openssl", opensslFingerprint(der), true},
+		{"hex", fmt.Sprintf("%x", digest), true},
+		{"whitespace", fmt.Sprintf("  %X\n", digest), true},
+		{"not hex", strings.Repeat("zz", sha256.Size), false},
+		{"odd length", fmt.Sprintf("%x", digest)[1:], false},
+		{"too short", fmt.Sprintf("%x", digest[:20]), false},
+		{"too long", fmt.Sprintf("%x00", digest), false},
+		{"empty colons", ":::", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pin, err := parseFingerprint(tc.fingerprint)
+			if !tc.valid {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q", tc.fingerprint)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not parse %q: %s", tc.fingerprint, err)
+			}
+
+			if string(pin) != string(digest[:]) {
+				t.Errorf("expected the pin to be the certificate digest, got %X", pin)
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	der, caPath := selfSigned(t)
+	other, _ := selfSigned(t)
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n"), 0644); err != nil {
+		t.Fatalf("could not write invalid CA bundle: %s", err)
+	}
+
+	tests := []struct {
+		name        string
+		caPath      string
+		fingerprint string
+		err         string // the error must contain err, or no error if empty
+		insecure    bool
+	}{
+		{"missing ca", filepath.Join(t.TempDir(), "missing.pem"), "", "could not read CA bundle", false},
+		{"invalid pem", invalid, "", "no PEM encoded certificates", false},
+		{"malformed pin", "", "not-a-fingerprint", "could not parse certificate fingerprint", false},
+		{"short pin", "", "AB:CD", "must be a 32 byte SHA-256 digest", false},
+		{"ca", caPath, "", "", false},
+		{"pin", "", opensslFingerprint(der), "", true},
+		{"ca and pin", caPath, opensslFingerprint(der), "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, err := tlsConfig(tc.caPath, tc.fingerprint)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not create tls config: %s", err)
+			}
+
+			// The chain is only left unverified when the pin is the only trust anchor.
+			if conf.InsecureSkipVerify != tc.insecure {
+				t.Errorf("expected insecure skip verify to be %t", tc.insecure)
+			}
+
+			if (conf.RootCAs != nil) != (tc.caPath != "") {
+				t.Errorf("expected root CAs only when a CA bundle is specified")
+			}
+
+			if tc.fingerprint == "" {
+				if conf.VerifyPeerCertificate != nil {
+					t.Error("expected no peer verification without a pinned fingerprint")
+				}
+				return
+			}
+
+			if err = conf.VerifyPeerCertificate([][]byte{der}, nil); err != nil {
+				t.Errorf("expected the pinned certificate to be verified: %s", err)
+			}
+
+			if err = conf.VerifyPeerCertificate([][]byte{other}, nil); err == nil {
+				t.Error("expected a certificate that does not match the pin to be rejected")
+			}
+
+			if err = conf.VerifyPeerCertificate(nil, nil); err == nil {
+				t.Error("expected an error when the broker presents no certificates")
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package sonar
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mimetype "github.com/rotationalio/go-ensign/mimetype/v1beta1"
+)
+
+var ErrUnknownMimetype = errors.New("no codec for mimetype")
+
+// Codec serializes pings as event data. The mimetype of a ping event is set from the
+// codec that encoded it so that listeners can select the matching decoder.
+type Codec interface {
+	Marshal(*Ping) ([]byte, error)
+	Unmarshal([]byte, *Ping) error
+	Mimetype() mimetype.MIME
+}
+
+// ParseCodec returns the codec with the specified name (msgpack or json).
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "msgpack":
+		return MsgPackCodec{}, nil
+	case "json":
+		return JSONCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q: specify msgpack or json", name)
+	}
+}
+
+// CodecFor returns the codec that decodes events with the specified mimetype.
+func CodecFor(mime mimetype.MIME) (Codec, error) {
+	switch mime {
+	case mimetype.ApplicationMsgPack:
+		return MsgPackCodec{}, nil
+	case mimetype.ApplicationJSON:
+		return JSONCodec{}, nil
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnknownMimetype, mime.MimeType())
+	}
+}
+
+// MsgPackCodec is the default, compact codec for pings.
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) Marshal(p *Ping) ([]byte, error) {
+	return p.Marshal()
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, p *Ping) error {
+	return p.Unmarshal(data)
+}
+
+func (MsgPackCodec) Mimetype() mimetype.MIME {
+	return mimetype.ApplicationMsgPack
+}
+
+// JSONCodec encodes pings as JSON for consumers that cannot read msgpack. The wire
+// format uses the same field names as msgpack rather than the output format of
+// Ping.MarshalJSON, which includes the receive-side fields.
+type JSONCodec struct{}
+
+// wirePing has the fields of a ping without its methods so that the JSON codec does not
+// use Ping.MarshalJSON.
+type wirePing Ping
+
+func (JSONCodec) Marshal(p *Ping) ([]byte, error) {
+	return json.Marshal((*wirePing)(p))
+}
+
+func (JSONCodec) Unmarshal(data []byte, p *Ping) error {
+	p.Received = time.Now()
+	p.NBytes = len(data)
+	return json.Unmarshal(data, (*wirePing)(p))
+}
+
+func (JSONCodec) Mimetype() mimetype.MIME {
+	return mimetype.ApplicationJSON
+}
@@ -0,0 +1,96 @@
+package sonar_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	mimetype "github.com/rotationalio/go-ensign/mimetype/v1beta1"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []sonar.Codec{sonar.MsgPackCodec{}, sonar.JSONCodec{}}
+
+	pings := []struct {
+		name  string
+		sonar *sonar.Sonar
+		edit  func(*sonar.Ping)
+	}{
+		{"default", sonar.New(), nil},
+		{"identity", sonar.New(sonar.WithHostname("probe"), sonar.WithIPAddress("192.0.2.1"), sonar.WithToken("run-1"), sonar.WithMarker("canary")), nil},
+		{"meta", sonar.New(sonar.WithMeta(map[string]string{"region": "us-east-1", "az": "a"})), nil},
+		{"padding", sonar.New(sonar.WithSize(512)), nil},
+		{"ttl", sonar.NewWithTTL(5 * time.Second), nil},
+		{"farewell", sonar.New(), func(p *sonar.Ping) { p.Farewell = true }},
+		{"reply", sonar.New(), func(p *sonar.Ping) { p.Echoed = true }},
+	}
+
+	for _, codec := range codecs {
+		for _, tc := range pings {
+			t.Run(codec.Mimetype().MimeType()+"/"+tc.name, func(t *testing.T) {
+				ping := tc.sonar.Next()
+				defer ping.Release()
+				if tc.edit != nil {
+					tc.edit(ping)
+				}
+
+				data, err := codec.Marshal(ping)
+				if err != nil {
+					t.Fatalf("could not marshal ping: %s", err)
+				}
+
+				decoded := &sonar.Ping{}
+				if err = codec.Unmarshal(data, decoded); err != nil {
+					t.Fatalf("could not unmarshal ping: %s", err)
+				}
+
+				if !ping.Equal(decoded) {
+					t.Fatalf("round trip changed the ping:\n%s", ping.Diff(decoded))
+				}
+
+				if decoded.Size() != len(data) {
+					t.Errorf("expected size %d, got %d", len(data), decoded.Size())
+				}
+			})
+		}
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for name, expected := range map[string]mimetype.MIME{
+		"msgpack":   mimetype.ApplicationMsgPack,
+		" MsgPack ": mimetype.ApplicationMsgPack,
+		"json":      mimetype.ApplicationJSON,
+	} {
+		codec, err := sonar.ParseCodec(name)
+		if err != nil {
+			t.Fatalf("could not parse codec %q: %s", name, err)
+		}
+
+		if codec.Mimetype() != expected {
+			t.Errorf("expected %q to parse as %s, got %s", name, expected, codec.Mimetype())
+		}
+	}
+
+	if _, err := sonar.ParseCodec("protobuf"); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	for _, codec := range []sonar.Codec{sonar.MsgPackCodec{}, sonar.JSONCodec{}} {
+		found, err := sonar.CodecFor(codec.Mimetype())
+		if err != nil {
+			t.Fatalf("no codec for %s: %s", codec.Mimetype(), err)
+		}
+
+		if found != codec {
+			t.Errorf("expected %T for %s, got %T", codec, codec.Mimetype(), found)
+		}
+	}
+
+	if _, err := sonar.CodecFor(mimetype.TextPlain); !errors.Is(err, sonar.ErrUnknownMimetype) {
+		t.Errorf("expected unknown mimetype error, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package sonar
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/rotationalio/go-ensign"
+	mimetype "github.com/rotationalio/go-ensign/mimetype/v1beta1"
+)
+
+// Encrypted events are marked with metadata since the octet-stream mimetype of the
+// ciphertext is indistinguishable from an unspecified mimetype.
+const (
+	EncryptionKey        = "encryption"
+	EncryptionAlgorithm  = "aes-256-gcm"
+	EncryptedMimetype    = "application/octet-stream"
+	PlaintextMimetypeKey = "plaintext-mimetype"
+)
+
+var ErrCiphertextTooShort = errors.New("ciphertext is shorter than the nonce")
+
+// Cipher encrypts and decrypts ping data with AES-256-GCM using a random nonce per
+// message that is prepended to the ciphertext. The key is derived from a shared secret
+// by hashing it with SHA-256 so that any passphrase can be used on the command line.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(secret string) (_ *Cipher, err error) {
+	if secret == "" {
+		return nil, errors.New("an encryption key is required")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+
+	var block cipher.Block
+	if block, err = aes.NewCipher(key[:]); err != nil {
+		return nil, err
+	}
+
+	c := &Cipher{}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cipher) Encrypt(plaintext []byte) (_ []byte, err error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, ErrCiphertextTooShort
+	}
+	return c.aead.Open(nil, ciphertext[:size], ciphertext[size:], nil)
+}
+
+// Seal encrypts the event data in place and marks the event as encrypted.
+func (c *Cipher) Seal(event *ensign.Event) (err error) {
+	if event.Data, err = c.Encrypt(event.Data); err != nil {
+		return err
+	}
+
+	if event.Metadata == nil {
+		event.Metadata = make(ensign.Metadata)
+	}
+	event.Metadata.Set(EncryptionKey, EncryptionAlgorithm)
+	event.Metadata.Set(PlaintextMimetypeKey, event.Mimetype.MimeType())
+	event.Mimetype = mimetype.MustParse(EncryptedMimetype)
+	return nil
+}
+
+// Open decrypts the data of an encrypted event and returns the ping data.
+func (c *Cipher) Open(event *ensign.Event) ([]byte, error) {
+	return c.Decrypt(event.Data)
+}
+
+// PlaintextMimetype returns the mimetype of an encrypted event's data before it was
+// sealed; events sealed without recording the mimetype are assumed to be msgpack.
+func PlaintextMimetype(event *ensign.Event) mimetype.MIME {
+	if mime, err := mimetype.Parse(event.Metadata.Get(PlaintextMimetypeKey)); err == nil {
+		return mime
+	}
+	return mimetype.ApplicationMsgPack
+}
+
+// Encrypted returns true if the event is marked as encrypted by a Cipher.
+func Encrypted(event *ensign.Event) bool {
+	return event.Metadata.Get(EncryptionKey) == EncryptionAlgorithm
+}
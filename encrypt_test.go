@@ -0,0 +1,113 @@
+package sonar_test
+
+import (
+	"errors"
+	"testing"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	seal, err := sonar.NewCipher("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("could not create cipher: %s", err)
+	}
+
+	for _, codec := range []sonar.Codec{sonar.MsgPackCodec{}, sonar.JSONCodec{}} {
+		ping := sonar.New(sonar.WithMeta(map[string]string{"env": "test"})).Next()
+		event, err := ping.Event(codec)
+		if err != nil {
+			t.Fatalf("could not create event: %s", err)
+		}
+
+		plaintext := append([]byte(nil), event.Data...)
+		if err = seal.Seal(event); err != nil {
+			t.Fatalf("could not seal event: %s", err)
+		}
+
+		if !sonar.Encrypted(event) {
+			t.Fatal("expected sealed event to be marked as encrypted")
+		}
+
+		if string(event.Data) == string(plaintext) {
+			t.Fatal("expected sealed event data to be encrypted")
+		}
+
+		if mime := sonar.PlaintextMimetype(event); mime != codec.Mimetype() {
+			t.Errorf("expected plaintext mimetype %s, got %s", codec.Mimetype(), mime)
+		}
+
+		decoded, _, err := sonar.Decode(event, seal)
+		if err != nil {
+			t.Fatalf("could not decode sealed event: %s", err)
+		}
+
+		if !ping.Equal(decoded) {
+			t.Fatalf("decrypted ping does not match:\n%s", ping.Diff(decoded))
+		}
+		ping.Release()
+	}
+}
+
+func TestCipherWrongKey(t *testing.T) {
+	seal, err := sonar.NewCipher("the right key")
+	if err != nil {
+		t.Fatalf("could not create cipher: %s", err)
+	}
+
+	wrong, err := sonar.NewCipher("the wrong key")
+	if err != nil {
+		t.Fatalf("could not create cipher: %s", err)
+	}
+
+	ping := sonar.New().Next()
+	defer ping.Release()
+
+	event, err := ping.Event(sonar.MsgPackCodec{})
+	if err != nil {
+		t.Fatalf("could not create event: %s", err)
+	}
+
+	if err = seal.Seal(event); err != nil {
+		t.Fatalf("could not seal event: %s", err)
+	}
+
+	if _, err = wrong.Open(event); err == nil {
+		t.Fatal("expected decrypting with the wrong key to fail")
+	}
+
+	if _, _, err = sonar.Decode(event, wrong); !errors.Is(err, sonar.ErrDecrypt) {
+		t.Fatalf("expected a decrypt error decoding with the wrong key, got %v", err)
+	}
+
+	// Without a cipher the ciphertext cannot be decoded as a ping.
+	if _, _, err = sonar.Decode(event, nil); !errors.Is(err, sonar.ErrUnknownMimetype) {
+		t.Fatalf("expected unknown mimetype decoding without a cipher, got %v", err)
+	}
+}
+
+func TestCipherErrors(t *testing.T) {
+	if _, err := sonar.NewCipher(""); err == nil {
+		t.Fatal("expected an error creating a cipher without a key")
+	}
+
+	seal, err := sonar.NewCipher("secret")
+	if err != nil {
+		t.Fatalf("could not create cipher: %s", err)
+	}
+
+	if _, err = seal.Decrypt([]byte("short")); !errors.Is(err, sonar.ErrCiphertextTooShort) {
+		t.Fatalf("expected ciphertext too short error, got %v", err)
+	}
+
+	// Tampering with the ciphertext is detected by the authentication tag.
+	ciphertext, err := seal.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatalf("could not encrypt: %s", err)
+	}
+
+	ciphertext[len(ciphertext)-1] ^= 0xff
+	if _, err = seal.Decrypt(ciphertext); err == nil {
+		t.Fatal("expected tampered ciphertext to fail to decrypt")
+	}
+}
@@ -0,0 +1,32 @@
+package sonar
+
+import "time"
+
+// Jitter estimates the interarrival jitter of pings as described by RFC 3550: the mean
+// deviation of the difference in transit time between consecutive pings, smoothed with
+// a gain of 1/16 so that the estimate reduces noise but still converges quickly. Since
+// jitter is computed from differences in transit time, a constant clock offset between
+// the sender and the receiver does not affect it. Pings from each sender should be
+// observed by a separate accumulator.
+type Jitter struct {
+	last   time.Duration
+	jitter float64
+	count  uint64
+}
+
+// Observe the transit time (e.g. the Timedelta) of the next ping from the sender.
+func (j *Jitter) Observe(delta time.Duration) {
+	if j.count++; j.count > 1 {
+		d := float64(delta - j.last)
+		if d < 0 {
+			d = -d
+		}
+		j.jitter += (d - j.jitter) / 16
+	}
+	j.last = delta
+}
+
+// Jitter returns the current jitter estimate; it is zero until two pings are observed.
+func (j *Jitter) Jitter() time.Duration {
+	return time.Duration(j.jitter)
+}
@@ -0,0 +1,58 @@
+package sonar_test
+
+import (
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestJitter(t *testing.T) {
+	j := &sonar.Jitter{}
+	if j.Jitter() != 0 {
+		t.Fatalf("expected no jitter before any pings, got %s", j.Jitter())
+	}
+
+	// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16 from RFC 3550 section 6.4.1
+	tests := []struct {
+		delta    time.Duration
+		expected time.Duration
+	}{
+		{10 * time.Millisecond, 0},
+		{12 * time.Millisecond, 125 * time.Microsecond},
+		{11 * time.Millisecond, 179687 * time.Nanosecond},
+		{11 * time.Millisecond, 168457 * time.Nanosecond},
+		{7 * time.Millisecond, 407928 * time.Nanosecond},
+	}
+
+	for i, tc := range tests {
+		j.Observe(tc.delta)
+		if got := j.Jitter(); got < tc.expected-time.Nanosecond || got > tc.expected+time.Nanosecond {
+			t.Errorf("after delta %d expected jitter %s, got %s", i, tc.expected, got)
+		}
+	}
+}
+
+func TestJitterClockOffset(t *testing.T) {
+	// Jitter is computed from differences in transit time, so a constant offset between
+	// the sender and receiver clocks does not change it.
+	a, b := &sonar.Jitter{}, &sonar.Jitter{}
+	for _, delta := range []time.Duration{3, 8, 2, 9, 4, 4, 6} {
+		a.Observe(delta * time.Millisecond)
+		b.Observe(delta*time.Millisecond - time.Hour)
+	}
+
+	if a.Jitter() != b.Jitter() {
+		t.Fatalf("expected clock offset not to affect jitter: %s != %s", a.Jitter(), b.Jitter())
+	}
+
+	// A constant transit time has no jitter.
+	c := &sonar.Jitter{}
+	for i := 0; i < 10; i++ {
+		c.Observe(5 * time.Millisecond)
+	}
+
+	if c.Jitter() != 0 {
+		t.Fatalf("expected no jitter with a constant transit time, got %s", c.Jitter())
+	}
+}
@@ -0,0 +1,140 @@
+package sonar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rotationalio/go-ensign"
+	api "github.com/rotationalio/go-ensign/api/v1beta1"
+)
+
+var (
+	ErrSubscriptionClosed = errors.New("subscription closed by the server")
+	ErrDecrypt            = errors.New("could not decrypt ping")
+)
+
+// Listener subscribes to pings and invokes a handler for each decoded ping so that
+// ping monitoring can be embedded in other services. A ping is acked if the handler
+// returns nil and nacked if it returns an error. Events that cannot be decoded as pings
+// are nacked without calling the handler.
+type Listener struct {
+	client   *ensign.Client
+	handler  func(*Ping) error
+	topics   []string
+	seal     *Cipher
+	onDecode func(event *ensign.Event, err error)
+	onSub    func()
+}
+
+// ListenerOption configures a Listener.
+type ListenerOption func(l *Listener)
+
+// SubscribeTo sets the topics to subscribe to.
+func SubscribeTo(topics ...string) ListenerOption {
+	return func(l *Listener) {
+		l.topics = topics
+	}
+}
+
+// DecryptWith decrypts pings that were sealed by a Cipher with the same secret.
+func DecryptWith(seal *Cipher) ListenerOption {
+	return func(l *Listener) {
+		l.seal = seal
+	}
+}
+
+// OnDecodeError is called with events that could not be decoded as pings, e.g. to log
+// or count them.
+func OnDecodeError(handler func(event *ensign.Event, err error)) ListenerOption {
+	return func(l *Listener) {
+		l.onDecode = handler
+	}
+}
+
+// OnSubscribe is called once the subscription is created, e.g. to start publishing
+// only once the listener will receive the published pings.
+func OnSubscribe(handler func()) ListenerOption {
+	return func(l *Listener) {
+		l.onSub = handler
+	}
+}
+
+func NewListener(client *ensign.Client, handler func(*Ping) error, opts ...ListenerOption) *Listener {
+	l := &Listener{client: client, handler: handler}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Listen handles pings until the context is done.
+func (l *Listener) Listen(ctx context.Context) (err error) {
+	var sub *ensign.Subscription
+	if sub, err = l.client.Subscribe(l.topics...); err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	if l.onSub != nil {
+		l.onSub()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				return ErrSubscriptionClosed
+			}
+			l.handle(event)
+		}
+	}
+}
+
+func (l *Listener) handle(event *ensign.Event) {
+	ping, _, err := Decode(event, l.seal)
+	if err != nil {
+		if l.onDecode != nil {
+			l.onDecode(event, err)
+		}
+
+		if errors.Is(err, ErrUnknownMimetype) {
+			event.Nack(api.Nack_UNHANDLED_MIMETYPE)
+		} else {
+			event.Nack(api.Nack_DELIVER_AGAIN_NOT_ME)
+		}
+		return
+	}
+
+	if err = l.handler(ping); err != nil {
+		event.Nack(api.Nack_UNPROCESSED)
+		return
+	}
+	event.Ack()
+}
+
+// Decode a ping from an event, decrypting it with the cipher if it is encrypted and
+// selecting the codec from the event mimetype. The codec is returned so that replies
+// can be encoded like the ping. Errors decrypting the event wrap ErrDecrypt and events
+// without a codec return ErrUnknownMimetype. A new ping is allocated for every event.
+func Decode(event *ensign.Event, seal *Cipher) (_ *Ping, codec Codec, err error) {
+	data, mime := event.Data, event.Mimetype
+	if seal != nil && Encrypted(event) {
+		if data, err = seal.Open(event); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrDecrypt, err)
+		}
+		mime = PlaintextMimetype(event)
+	}
+
+	if codec, err = CodecFor(mime); err != nil {
+		return nil, nil, err
+	}
+
+	ping := &Ping{}
+	if err = codec.Unmarshal(data, ping); err != nil {
+		return nil, codec, err
+	}
+	return ping, codec, nil
+}
@@ -0,0 +1,87 @@
+package sonar
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const MetricsNamespace = "ensign_sonar"
+
+// Metrics are the Prometheus collectors that describe the pings received by a
+// listener. The collectors are registered with their own registry rather than the
+// default registry so that multiple listeners can be embedded in one process.
+type Metrics struct {
+	Received prometheus.Counter
+	Failures prometheus.Counter
+	Latency  prometheus.Histogram
+	Sequence *prometheus.GaugeVec
+	Jitter   *prometheus.GaugeVec
+	registry *prometheus.Registry
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Received: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "pings_received_total",
+			Help:      "The number of pings received and decoded by the listener.",
+		}),
+		Failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "unmarshal_failures_total",
+			Help:      "The number of received events that could not be decoded as pings.",
+		}),
+		Latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "latency_seconds",
+			Help:      "The time between when a ping was sent and when it was received.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+		Sequence: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "last_sequence",
+			Help:      "The sequence number of the last ping received from each host.",
+		}, []string{"hostname"}),
+		Jitter: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "jitter_seconds",
+			Help:      "The RFC 3550 interarrival jitter of the pings received from each host.",
+		}, []string{"hostname"}),
+		registry: prometheus.NewRegistry(),
+	}
+
+	m.registry.MustRegister(m.Received, m.Failures, m.Latency, m.Sequence, m.Jitter)
+	return m
+}
+
+// Observe updates the collectors from a received ping.
+func (m *Metrics) Observe(p *Ping) {
+	m.Received.Inc()
+	m.Latency.Observe(p.Timedelta().Seconds())
+	m.Sequence.WithLabelValues(p.Hostname).Set(float64(p.Sequence))
+}
+
+// Handler returns an http handler that exposes the metrics for scraping.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve the metrics on the /metrics endpoint of an HTTP server bound to addr. The
+// server runs in its own go routine until it is shut down by the caller.
+func (m *Metrics) Serve(addr string) (srv *http.Server, err error) {
+	var sock net.Listener
+	if sock, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+
+	srv = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(sock)
+	return srv, nil
+}
@@ -0,0 +1,38 @@
+package sonar
+
+import "time"
+
+// OrderChecker detects reordering using the ping timestamps rather than the sequence,
+// which is useful when sequences are reset or unavailable. Timestamps are only
+// comparable for pings from the same host, so the latest timestamp is kept per host.
+// Timestamps that are equal or that go backwards by less than the clock resolution are
+// treated as ties rather than reordering.
+type OrderChecker struct {
+	Resolution time.Duration
+	Reordered  uint64
+	latest     map[string]time.Time
+}
+
+func NewOrderChecker(resolution time.Duration) *OrderChecker {
+	return &OrderChecker{
+		Resolution: resolution,
+		latest:     make(map[string]time.Time),
+	}
+}
+
+// Check returns false if the ping's timestamp is before the latest timestamp seen from
+// its host, along with how far back in time it jumped.
+func (o *OrderChecker) Check(p *Ping) (ordered bool, behind time.Duration) {
+	latest, ok := o.latest[p.Hostname]
+	if !ok || !p.Timestamp.Before(latest) {
+		o.latest[p.Hostname] = p.Timestamp
+		return true, 0
+	}
+
+	if behind = latest.Sub(p.Timestamp); behind <= o.Resolution {
+		return true, 0
+	}
+
+	o.Reordered++
+	return false, behind
+}
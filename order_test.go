@@ -0,0 +1,63 @@
+package sonar_test
+
+import (
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestOrderChecker(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(host string, offset time.Duration) *sonar.Ping {
+		return &sonar.Ping{Hostname: host, Timestamp: start.Add(offset)}
+	}
+
+	tests := []struct {
+		name    string
+		ping    *sonar.Ping
+		ordered bool
+		behind  time.Duration
+	}{
+		{"first", at("alpha", 10*time.Millisecond), true, 0},
+		{"later", at("alpha", 20*time.Millisecond), true, 0},
+		{"equal timestamp tie", at("alpha", 20*time.Millisecond), true, 0},
+		{"within resolution", at("alpha", 19*time.Millisecond), true, 0},
+		{"at resolution", at("alpha", 18*time.Millisecond), true, 0},
+		{"behind", at("alpha", 5*time.Millisecond), false, 15 * time.Millisecond},
+		{"other host", at("bravo", 0), true, 0},
+		{"still behind latest", at("alpha", 15*time.Millisecond), false, 5 * time.Millisecond},
+		{"later again", at("alpha", 30*time.Millisecond), true, 0},
+	}
+
+	order := sonar.NewOrderChecker(2 * time.Millisecond)
+	for _, tc := range tests {
+		ordered, behind := order.Check(tc.ping)
+		if ordered != tc.ordered || behind != tc.behind {
+			t.Errorf("%s: expected ordered %t behind %s, got ordered %t behind %s", tc.name, tc.ordered, tc.behind, ordered, behind)
+		}
+	}
+
+	if order.Reordered != 2 {
+		t.Errorf("expected 2 reordered pings, got %d", order.Reordered)
+	}
+}
+
+func TestOrderCheckerNoResolution(t *testing.T) {
+	// Without a resolution only equal timestamps are ties.
+	order := sonar.NewOrderChecker(0)
+	now := time.Now()
+
+	pings := []*sonar.Ping{
+		{Hostname: "alpha", Timestamp: now},
+		{Hostname: "alpha", Timestamp: now},
+		{Hostname: "alpha", Timestamp: now.Add(-time.Nanosecond)},
+	}
+
+	expected := []bool{true, true, false}
+	for i, ping := range pings {
+		if ordered, _ := order.Check(ping); ordered != expected[i] {
+			t.Errorf("ping %d: expected ordered %t, got %t", i, expected[i], ordered)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package sonar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rotationalio/go-ensign"
+)
+
+// FloodAckTimeout is how long a flooding publisher waits for each ping to be acked.
+const (
+	FloodAckTimeout   = 5 * time.Second
+	floodPollInterval = 100 * time.Microsecond
+	maxScheduleLag    = time.Second
+)
+
+var ErrAckTimeout = errors.New("timed out waiting for the event to be acked")
+
+// Publisher publishes pings from a Sonar to one or more topics at a specified rate so
+// that the sonar generator can be embedded in other Go programs. The CLI is a thin
+// wrapper around the publisher that adds progress output and reporting via hooks.
+type Publisher struct {
+	mu        sync.Mutex
+	client    *ensign.Client
+	topics    []string
+	pings     *Sonar
+	codec     Codec
+	seal      *Cipher
+	rate      func(now time.Time) float64
+	count     uint64
+	workers   int
+	dryRun    bool
+	flood     bool
+	hooks     sync.Mutex // serializes the hooks when publishing with multiple workers
+	before    func(ping *Ping)
+	after     func(topic string, ping *Ping, event *ensign.Event, err error)
+	onError   func(err error) error
+	sent      uint64
+	errors    uint64
+	published map[string]uint64
+}
+
+// PublisherOption configures a Publisher.
+type PublisherOption func(p *Publisher)
+
+// WithRate sets the publish rate in pings per second; a rate <= 0 publishes as fast as
+// possible, which is the default.
+func WithRate(hz float64) PublisherOption {
+	return WithRateFunc(func(time.Time) float64 { return hz })
+}
+
+// WithRateFunc varies the publish rate over time, e.g. to ramp up the rate. The rate
+// is recomputed after every ping is published.
+func WithRateFunc(rate func(now time.Time) float64) PublisherOption {
+	return func(p *Publisher) {
+		p.rate = rate
+	}
+}
+
+// WithCount stops the publisher after the specified number of pings are sent.
+func WithCount(count uint64) PublisherOption {
+	return func(p *Publisher) {
+		p.count = count
+	}
+}
+
+// WithWorkers publishes pings with the specified number of concurrent workers, since
+// a single publisher that blocks on each publish cannot keep up at very high rates. The
+// rate still governs how quickly pings are produced; the workers only govern how many
+// pings may be published in parallel, so pings are queued when every worker is busy.
+func WithWorkers(workers int) PublisherOption {
+	return func(p *Publisher) {
+		p.workers = workers
+	}
+}
+
+// WithCodec sets the serialization format of the pings (msgpack by default).
+func WithCodec(codec Codec) PublisherOption {
+	return func(p *Publisher) {
+		p.codec = codec
+	}
+}
+
+// WithPings sets the generator of the published pings; by default New() is used.
+func WithPings(pings *Sonar) PublisherOption {
+	return func(p *Publisher) {
+		p.pings = pings
+	}
+}
+
+// WithCipher encrypts every published ping.
+func WithCipher(seal *Cipher) PublisherOption {
+	return func(p *Publisher) {
+		p.seal = seal
+	}
+}
+
+// WithFanout publishes pings round-robin across the additional topics.
+func WithFanout(topics ...string) PublisherOption {
+	return func(p *Publisher) {
+		p.topics = append(p.topics, topics...)
+	}
+}
+
+// Flood publishes the next ping as soon as the previous ping is acked, similar to
+// ping -f. Unlike publishing at the maximum rate (a rate <= 0), which does not wait for
+// acks, flooding bounds the number of outstanding events to one so the publish rate
+// is limited by the broker's ack latency. The rate is ignored when flooding.
+func Flood() PublisherOption {
+	return func(p *Publisher) {
+		p.flood = true
+	}
+}
+
+// DryRun creates the events for the pings without publishing them, e.g. to inspect
+// the generated pings or to benchmark the generator; no client is required.
+func DryRun() PublisherOption {
+	return func(p *Publisher) {
+		p.dryRun = true
+	}
+}
+
+// WithHooks sets functions that are called before each ping is published and after
+// it is published to a topic with the resulting event or error. Either hook may be nil.
+// The ping is released to be reused once it is published, so hooks must not retain it.
+// Hooks are never called concurrently, but with multiple workers the hooks of
+// different pings may interleave.
+func WithHooks(before func(ping *Ping), after func(topic string, ping *Ping, event *ensign.Event, err error)) PublisherOption {
+	return func(p *Publisher) {
+		p.before = before
+		p.after = after
+	}
+}
+
+// WithErrorHandler is called when a ping cannot be published, e.g. to reconnect. If
+// the handler returns an error the publisher stops; by default errors are only counted.
+// Like the hooks, the handler is never called concurrently.
+func WithErrorHandler(handler func(err error) error) PublisherOption {
+	return func(p *Publisher) {
+		p.onError = handler
+	}
+}
+
+func NewPublisher(client *ensign.Client, topic string, opts ...PublisherOption) *Publisher {
+	p := &Publisher{
+		client:    client,
+		topics:    []string{topic},
+		codec:     MsgPackCodec{},
+		rate:      func(time.Time) float64 { return 0 },
+		published: make(map[string]uint64),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.pings == nil {
+		p.pings = New()
+	}
+	return p
+}
+
+// Run publishes pings until the context is done or the count is reached. An error is
+// only returned if the error handler could not recover from a publish error.
+func (p *Publisher) Run(ctx context.Context) (err error) {
+	if p.workers > 1 {
+		return p.runWorkers(ctx)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	pace := p.schedule(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			if err = p.Send(); err != nil || p.Done() {
+				return err
+			}
+			timer.Reset(pace.Next(time.Now()))
+		}
+	}
+}
+
+// Produce pings at the rate and publish them with a pool of workers. The queue is
+// bounded so that the producer falls behind the rate rather than queueing pings
+// without limit when the workers cannot keep up. The first error returned by a worker
+// stops the producer.
+func (p *Publisher) runWorkers(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		once   sync.Once
+		queue  = make(chan *Ping, p.workers)
+		failed error
+	)
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ping := range queue {
+				if err := p.send(ping); err != nil {
+					once.Do(func() { failed = err })
+					cancel()
+				}
+			}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var produced uint64
+	pace := p.schedule(time.Now())
+produce:
+	for {
+		select {
+		case <-ctx.Done():
+			break produce
+		case <-timer.C:
+			ping := p.pings.Next()
+			select {
+			case queue <- ping:
+			case <-ctx.Done():
+				ping.Release()
+				break produce
+			}
+
+			if produced++; p.count > 0 && produced >= p.count {
+				break produce
+			}
+			timer.Reset(pace.Next(time.Now()))
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+// Create the schedule that paces the pings at the publisher's rate from the start time.
+func (p *Publisher) schedule(start time.Time) *schedule {
+	rate := p.rate
+	if p.flood {
+		rate = func(time.Time) float64 { return 0 }
+	}
+	return &schedule{rate: rate, due: start}
+}
+
+// Paces pings at a rate by accumulating the time each ping is due from the interval at
+// the current rate rather than waiting an interval after each ping is sent. Timers
+// cannot fire precisely at sub-millisecond intervals and always fire late, so waiting
+// for an interval after every send drifts below the requested rate; accounting for the
+// due time means a late ping is followed by a shorter delay (or none) so that the long
+// run average matches the rate. If the publisher falls more than maxScheduleLag behind,
+// e.g. because publishing blocked, the schedule is reset rather than bursting to catch up.
+type schedule struct {
+	rate func(now time.Time) float64
+	due  time.Time
+}
+
+// Next returns the delay until the next ping is due, which is not positive if the ping
+// is already late.
+func (s *schedule) Next(now time.Time) time.Duration {
+	hz := s.rate(now)
+	if hz <= 0 {
+		s.due = now
+		return 0
+	}
+
+	if now.Sub(s.due) > maxScheduleLag {
+		s.due = now
+	}
+
+	s.due = s.due.Add(time.Duration(float64(time.Second) / hz))
+	return s.due.Sub(now)
+}
+
+// Send publishes the next ping to the next topic.
+func (p *Publisher) Send() error {
+	return p.send(p.pings.Next())
+}
+
+// Publish the ping to the next topic, releasing it once it is published.
+func (p *Publisher) send(ping *Ping) (err error) {
+	defer ping.Release()
+
+	p.mu.Lock()
+	topic := p.topics[p.sent%uint64(len(p.topics))]
+	p.sent++
+	p.mu.Unlock()
+
+	if p.before != nil {
+		p.hooks.Lock()
+		p.before(ping)
+		p.hooks.Unlock()
+	}
+
+	event, err := p.publish(ping, topic)
+	if err == nil && p.flood && !p.dryRun {
+		err = awaitAck(event, FloodAckTimeout)
+	}
+
+	// Pings are not published in dry-run mode so they are only counted as sent.
+	p.mu.Lock()
+	switch {
+	case err != nil:
+		p.errors++
+	case !p.dryRun:
+		p.published[topic]++
+	}
+	p.mu.Unlock()
+
+	p.hooks.Lock()
+	defer p.hooks.Unlock()
+
+	if p.after != nil {
+		p.after(topic, ping, event, err)
+	}
+
+	if err != nil && p.onError != nil {
+		return p.onError(err)
+	}
+	return nil
+}
+
+// Farewell publishes a farewell ping to every topic so listeners know the sender left.
+func (p *Publisher) Farewell() (err error) {
+	for _, topic := range p.topics {
+		ping := p.pings.Farewell()
+		if _, perr := p.publish(ping, topic); perr != nil {
+			err = perr
+		}
+		ping.Release()
+	}
+	return err
+}
+
+// Create the event for the ping, encrypting it if required, and publish it.
+func (p *Publisher) publish(ping *Ping, topic string) (event *ensign.Event, err error) {
+	if event, err = ping.Event(p.codec); err != nil {
+		return nil, fmt.Errorf("could not marshal ping: %w", err)
+	}
+
+	if p.seal != nil {
+		if err = p.seal.Seal(event); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.dryRun {
+		return event, nil
+	}
+
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+	return event, client.Publish(topic, event)
+}
+
+// Wait for the broker to ack the event, polling since the client does not notify the
+// publisher when an event is acked. An error is returned if the event is nacked.
+func awaitAck(event *ensign.Event, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		acked, err := event.Acked()
+		switch {
+		case acked:
+			return nil
+		case err != nil:
+			return err
+		case time.Now().After(deadline):
+			return ErrAckTimeout
+		}
+		time.Sleep(floodPollInterval)
+	}
+}
+
+// Done returns true once the count of pings has been sent.
+func (p *Publisher) Done() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count > 0 && p.sent >= p.count
+}
+
+// SetClient replaces the client used to publish, e.g. after reconnecting.
+func (p *Publisher) SetClient(client *ensign.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.client = client
+}
+
+// Sent returns the number of pings sent, whether or not they were published.
+func (p *Publisher) Sent() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sent
+}
+
+// Errors returns the number of pings that could not be published.
+func (p *Publisher) Errors() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errors
+}
+
+// Published returns the number of pings successfully published to the topics, or to
+// all topics if none are specified. The counts are safe to read while publishing.
+func (p *Publisher) Published(topics ...string) (published uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(topics) == 0 {
+		for _, count := range p.published {
+			published += count
+		}
+		return published
+	}
+
+	for _, topic := range topics {
+		published += p.published[topic]
+	}
+	return published
+}
+
+// Summary returns the publish counts in the style of ping. Unlike a listener the
+// publisher cannot know how many pings were received, so it reports no loss.
+func (p *Publisher) Summary() string {
+	if p.dryRun {
+		return fmt.Sprintf("%d pings sent, none published (dry run)", p.Sent())
+	}
+	return fmt.Sprintf("%d pings sent, %d published, %d errors", p.Sent(), p.Published(), p.Errors())
+}
@@ -0,0 +1,147 @@
+package sonar
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/go-ensign"
+	mimetype "github.com/rotationalio/go-ensign/mimetype/v1beta1"
+)
+
+func TestScheduleRate(t *testing.T) {
+	tests := []struct {
+		hz       float64
+		duration time.Duration
+		latency  time.Duration // how late the timer fires after each delay
+	}{
+		{10, 10 * time.Second, 0},
+		{1000, time.Second, 0},
+		{1000, time.Second, 700 * time.Microsecond},
+		{5000, time.Second, time.Millisecond},
+		{20000, time.Second, 2 * time.Millisecond},
+		{3000, 3 * time.Second, 150 * time.Microsecond},
+	}
+
+	for _, tc := range tests {
+		start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+		pace := &schedule{rate: func(time.Time) float64 { return tc.hz }, due: start}
+
+		// Simulate the publish loop: a ping is sent whenever the timer fires. A timer
+		// that has to wait always fires late by the latency, which is longer than the
+		// interval at the highest rates; a timer reset with no delay fires immediately.
+		var sent int
+		now := start
+		for now.Before(start.Add(tc.duration)) {
+			sent++
+			if delay := pace.Next(now); delay > 0 {
+				now = now.Add(delay + tc.latency)
+			}
+		}
+
+		expected := tc.hz * tc.duration.Seconds()
+		if diff := float64(sent) - expected; diff < -0.01*expected || diff > 0.01*expected {
+			t.Errorf("at %0.0f Hz with %s latency expected %0.0f pings in %s, sent %d", tc.hz, tc.latency, expected, tc.duration, sent)
+		}
+	}
+}
+
+func TestScheduleLag(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	pace := &schedule{rate: func(time.Time) float64 { return 100 }, due: start}
+
+	if delay := pace.Next(start); delay != 10*time.Millisecond {
+		t.Fatalf("expected a 10ms delay, got %s", delay)
+	}
+
+	// A short stall is made up by sending the late pings without a delay.
+	if delay := pace.Next(start.Add(500 * time.Millisecond)); delay >= 0 {
+		t.Fatalf("expected no delay after a short stall, got %s", delay)
+	}
+
+	// A long stall resets the schedule rather than bursting to catch up.
+	stalled := start.Add(5 * time.Second)
+	if delay := pace.Next(stalled); delay != 10*time.Millisecond {
+		t.Fatalf("expected the schedule to reset after a long stall, got %s", delay)
+	}
+}
+
+func TestScheduleUnlimited(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	p := NewPublisher(nil, "testing", WithRate(-1))
+	pace := p.schedule(start)
+
+	for i := 0; i < 10; i++ {
+		if delay := pace.Next(start); delay != 0 {
+			t.Fatalf("expected no delay at an unlimited rate, got %s", delay)
+		}
+	}
+
+	// Flooding ignores the rate since each ping waits for the previous ack.
+	p = NewPublisher(nil, "testing", WithRate(10), Flood())
+	if delay := p.schedule(start).Next(start); delay != 0 {
+		t.Fatalf("expected no delay when flooding, got %s", delay)
+	}
+}
+
+func TestPublisherDryRun(t *testing.T) {
+	p := NewPublisher(nil, "testing", DryRun(), WithCount(3))
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("could not run publisher: %s", err)
+	}
+
+	// Pings are not published in dry-run mode so they cannot be reported as received.
+	if p.Sent() != 3 || p.Published() != 0 || p.Errors() != 0 {
+		t.Fatalf("expected 3 sent, 0 published, 0 errors, got %d sent, %d published, %d errors", p.Sent(), p.Published(), p.Errors())
+	}
+
+	if summary := p.Summary(); summary != "3 pings sent, none published (dry run)" {
+		t.Errorf("unexpected dry run summary %q", summary)
+	}
+}
+
+var errMarshal = errors.New("marshal failed")
+
+// A codec that cannot marshal any ping.
+type failingCodec struct{}
+
+func (failingCodec) Marshal(*Ping) ([]byte, error) { return nil, errMarshal }
+func (failingCodec) Unmarshal([]byte, *Ping) error { return errMarshal }
+func (failingCodec) Mimetype() mimetype.MIME       { return mimetype.ApplicationMsgPack }
+
+func TestPublisherMarshalError(t *testing.T) {
+	var reported []error
+	after := func(topic string, ping *Ping, event *ensign.Event, err error) {
+		reported = append(reported, err)
+	}
+
+	p := NewPublisher(nil, "testing", DryRun(), WithCount(3), WithCodec(failingCodec{}), WithHooks(nil, after))
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("expected marshal errors to be counted without stopping the publisher, got %s", err)
+	}
+
+	if p.Sent() != 3 || p.Published() != 0 || p.Errors() != 3 {
+		t.Fatalf("expected 3 sent, 0 published, 3 errors, got %d sent, %d published, %d errors", p.Sent(), p.Published(), p.Errors())
+	}
+
+	if len(reported) != 3 {
+		t.Fatalf("expected the error of each ping to be reported to the hook, got %d", len(reported))
+	}
+
+	for _, err := range reported {
+		if !errors.Is(err, errMarshal) {
+			t.Errorf("expected the marshal error to be reported, got %v", err)
+		}
+	}
+
+	// The error handler can stop the publisher at the first marshal error.
+	p = NewPublisher(nil, "testing", DryRun(), WithCount(3), WithCodec(failingCodec{}), WithErrorHandler(func(err error) error { return err }))
+	if err := p.Run(context.Background()); !errors.Is(err, errMarshal) {
+		t.Fatalf("expected the publisher to stop with the marshal error, got %v", err)
+	}
+
+	if p.Errors() != 1 {
+		t.Errorf("expected the publisher to stop after 1 error, got %d", p.Errors())
+	}
+}
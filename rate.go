@@ -0,0 +1,95 @@
+package sonar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateWindow computes the observed arrival rate in events per second over a sliding
+// window of the most recent arrivals.
+type RateWindow struct {
+	Window   time.Duration
+	arrivals []time.Time
+}
+
+func NewRateWindow(window time.Duration) *RateWindow {
+	return &RateWindow{Window: window}
+}
+
+// Observe records an arrival at the specified time.
+func (r *RateWindow) Observe(at time.Time) {
+	r.arrivals = append(r.arrivals, at)
+}
+
+// Rate returns the events per second in the window ending at now, discarding any
+// arrivals that have fallen out of the window.
+func (r *RateWindow) Rate(now time.Time) float64 {
+	start := now.Add(-r.Window)
+
+	i := 0
+	for i < len(r.arrivals) && !r.arrivals[i].After(start) {
+		i++
+	}
+	r.arrivals = r.arrivals[i:]
+
+	return float64(len(r.arrivals)) / r.Window.Seconds()
+}
+
+// Within returns true if the rate is within the fractional tolerance of the expected
+// rate, e.g. a tolerance of 0.1 allows 10% under or over delivery.
+func Within(rate, expected, tolerance float64) bool {
+	return rate >= expected*(1-tolerance) && rate <= expected*(1+tolerance)
+}
+
+// Rate units that may be used as the denominator of a rate specification.
+var rateUnits = map[string]time.Duration{
+	"ms":     time.Millisecond,
+	"s":      time.Second,
+	"sec":    time.Second,
+	"second": time.Second,
+	"m":      time.Minute,
+	"min":    time.Minute,
+	"minute": time.Minute,
+	"h":      time.Hour,
+	"hr":     time.Hour,
+	"hour":   time.Hour,
+}
+
+// ParseRate parses a rate specification into events per second. The specification is
+// either a bare number of events per second (e.g. 30 or -1 for as fast as possible) or
+// a count per unit or duration such as 100/s, 6000/min, or 1/5s.
+func ParseRate(spec string) (_ float64, err error) {
+	spec = strings.TrimSpace(spec)
+	count, per, ok := strings.Cut(spec, "/")
+	if !ok {
+		var hz float64
+		if hz, err = strconv.ParseFloat(spec, 64); err != nil {
+			return 0, fmt.Errorf("could not parse rate %q: specify events per second or count/unit", spec)
+		}
+		return hz, nil
+	}
+
+	var n float64
+	if n, err = strconv.ParseFloat(strings.TrimSpace(count), 64); err != nil || n <= 0 {
+		return 0, fmt.Errorf("could not parse rate %q: count must be a positive number", spec)
+	}
+
+	// Look up the unit, allowing plurals such as mins or seconds, before parsing it as a
+	// duration such as 5s or 250ms.
+	per = strings.ToLower(strings.TrimSpace(per))
+	interval, ok := rateUnits[per]
+	if !ok {
+		if interval, ok = rateUnits[strings.TrimSuffix(per, "s")]; !ok {
+			if interval, err = time.ParseDuration(per); err != nil {
+				return 0, fmt.Errorf("could not parse rate %q: unknown unit or duration %q", spec, per)
+			}
+		}
+	}
+
+	if interval <= 0 {
+		return 0, fmt.Errorf("could not parse rate %q: duration must be positive", spec)
+	}
+	return n / interval.Seconds(), nil
+}
@@ -0,0 +1,70 @@
+package sonar_test
+
+import (
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected float64
+	}{
+		{"30", 30},
+		{"0.5", 0.5},
+		{"-1", -1},
+		{" 10 ", 10},
+		{"100/s", 100},
+		{"100/sec", 100},
+		{"100/seconds", 100},
+		{"6000/min", 100},
+		{"6000/m", 100},
+		{"60/mins", 1},
+		{"3600/h", 1},
+		{"7200/hour", 2},
+		{"1/ms", 1000},
+		{"1/5s", 0.2},
+		{"1/250ms", 4},
+		{"3/1m30s", 3.0 / 90},
+		{"10 / S", 10},
+	}
+
+	for _, tc := range tests {
+		hz, err := sonar.ParseRate(tc.spec)
+		if err != nil {
+			t.Errorf("could not parse %q: %s", tc.spec, err)
+			continue
+		}
+
+		if diff := hz - tc.expected; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("expected %q to be %f/s, got %f/s", tc.spec, tc.expected, hz)
+		}
+	}
+}
+
+func TestParseRateErrors(t *testing.T) {
+	for _, spec := range []string{"", "fast", "/s", "0/s", "-5/s", "10/fortnight", "10/0s", "10/-1s"} {
+		if _, err := sonar.ParseRate(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	rates := sonar.NewRateWindow(2 * time.Second)
+	for i := 0; i < 40; i++ {
+		rates.Observe(start.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+
+	// Only the 20 arrivals in the last two seconds are counted.
+	if rate := rates.Rate(start.Add(3950 * time.Millisecond)); rate != 10 {
+		t.Errorf("expected 10/s, got %f/s", rate)
+	}
+
+	if !sonar.Within(9.5, 10, 0.1) || sonar.Within(8, 10, 0.1) || sonar.Within(12, 10, 0.1) {
+		t.Error("unexpected tolerance check")
+	}
+}
@@ -0,0 +1,69 @@
+package sonar
+
+import (
+	"sync"
+	"time"
+)
+
+// RoundTrips correlates sent pings with the replies echoed back by a responder to
+// measure the round trip time. Unlike Timedelta, the round trip time is not affected
+// by clock skew since it is the Elapsed time of the sent ping, which is measured by the
+// sender with the monotonic clock. Pings are correlated by sequence, so the caller must
+// ignore replies to other senders.
+type RoundTrips struct {
+	mu      sync.Mutex
+	pending map[uint64]Ping
+	stats   Stats
+}
+
+func NewRoundTrips() *RoundTrips {
+	return &RoundTrips{pending: make(map[uint64]Ping)}
+}
+
+// Sent records a copy of the ping that was sent, since sent pings may be released; it
+// should be called before the ping is published so that a fast reply is not missed.
+// Pings that were not created in this process are timed from when they are sent.
+func (r *RoundTrips) Sent(p *Ping) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sent := *p
+	if sent.created.IsZero() {
+		sent.created = time.Now()
+	}
+	r.pending[p.Sequence] = sent
+	r.stats.Transmitted++
+}
+
+// Replied correlates the reply with the ping that was sent, returning the round trip
+// time or false if no ping with the reply's sequence is pending.
+func (r *RoundTrips) Replied(p *Ping) (rtt time.Duration, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sent Ping
+	if sent, ok = r.pending[p.Sequence]; !ok {
+		return 0, false
+	}
+	delete(r.pending, p.Sequence)
+
+	sent.Received = time.Now()
+	rtt = sent.Elapsed()
+	r.stats.Received++
+	r.stats.Observe(rtt)
+	return rtt, true
+}
+
+// Pending returns the number of sent pings that have not been replied to.
+func (r *RoundTrips) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// Stats returns a copy of the round trip statistics.
+func (r *RoundTrips) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
@@ -0,0 +1,36 @@
+package sonar_test
+
+import (
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestRoundTrips(t *testing.T) {
+	rtts := sonar.NewRoundTrips()
+	ping := sonar.New().Next()
+	rtts.Sent(ping)
+
+	// Replies are decoded from events, so they do not have a monotonic clock reading.
+	reply := &sonar.Ping{Sequence: ping.Sequence}
+	ping.Release()
+	time.Sleep(5 * time.Millisecond)
+
+	rtt, ok := rtts.Replied(reply)
+	if !ok {
+		t.Fatal("expected the reply to be correlated with the sent ping")
+	}
+
+	if rtt < 5*time.Millisecond || rtt > time.Second {
+		t.Errorf("expected a round trip time of at least 5ms, got %s", rtt)
+	}
+
+	if _, ok = rtts.Replied(reply); ok {
+		t.Error("expected a second reply to the same ping not to be correlated")
+	}
+
+	if stats := rtts.Stats(); stats.Transmitted != 1 || stats.Received != 1 || rtts.Pending() != 0 {
+		t.Errorf("expected 1 ping transmitted and received with none pending, got %s with %d pending", stats.Summary(), rtts.Pending())
+	}
+}
@@ -0,0 +1,143 @@
+package sonar
+
+// SequenceTracker detects dropped, out-of-order, and duplicate pings using the
+// monotonically increasing ping sequence. Multiple senders may share a topic, so the
+// sequence state is kept per hostname. If the senders use a stride to interleave
+// sequences, the tracker must be created with the same stride to correctly compute gaps.
+type SequenceTracker struct {
+	Stride uint64
+	hosts  map[string]*hostSequence
+}
+
+type hostSequence struct {
+	first      uint64
+	highest    uint64
+	received   uint64
+	reordered  uint64
+	duplicates uint64
+	missing    []sequenceRange // gaps that have not been filled by reordered pings
+}
+
+// An inclusive range of sequences that have not been received.
+type sequenceRange struct {
+	lo, hi uint64
+}
+
+func NewSequenceTracker(stride uint64) *SequenceTracker {
+	if stride == 0 {
+		stride = 1
+	}
+
+	return &SequenceTracker{
+		Stride: stride,
+		hosts:  make(map[string]*hostSequence),
+	}
+}
+
+// Track records the ping's sequence, returning the sequence that was expected next
+// from the ping's host, the number of pings skipped if the ping arrived after a gap,
+// true if the ping arrived out of order (filling an earlier gap), and true if the ping
+// is a duplicate of a sequence that was already received, e.g. because it was
+// redelivered. Duplicates are not counted as received so they cannot hide a gap.
+func (t *SequenceTracker) Track(p *Ping) (expected, lost uint64, reordered, duplicate bool) {
+	host, ok := t.hosts[p.Hostname]
+	if !ok {
+		t.hosts[p.Hostname] = &hostSequence{first: p.Sequence, highest: p.Sequence, received: 1}
+		return p.Sequence, 0, false, false
+	}
+
+	expected = host.highest + t.Stride
+	switch {
+	case p.Sequence > host.highest:
+		if p.Sequence > expected {
+			lost = (p.Sequence - expected) / t.Stride
+			host.missing = append(host.missing, sequenceRange{lo: expected, hi: p.Sequence - t.Stride})
+		}
+		host.highest = p.Sequence
+	case p.Sequence < host.first:
+		if p.Sequence+t.Stride < host.first {
+			gap := sequenceRange{lo: p.Sequence + t.Stride, hi: host.first - t.Stride}
+			host.missing = append([]sequenceRange{gap}, host.missing...)
+		}
+		host.first = p.Sequence
+		host.reordered++
+		reordered = true
+	case t.fill(host, p.Sequence):
+		host.reordered++
+		reordered = true
+	default:
+		host.duplicates++
+		return expected, 0, false, true
+	}
+
+	host.received++
+	return expected, lost, reordered, false
+}
+
+// Remove the sequence from the missing ranges of the host, returning false if the
+// sequence was not missing.
+func (t *SequenceTracker) fill(host *hostSequence, sequence uint64) bool {
+	for i, gap := range host.missing {
+		if sequence < gap.lo || sequence > gap.hi || (sequence-gap.lo)%t.Stride != 0 {
+			continue
+		}
+
+		switch {
+		case gap.lo == gap.hi:
+			host.missing = append(host.missing[:i], host.missing[i+1:]...)
+		case sequence == gap.lo:
+			host.missing[i].lo += t.Stride
+		case sequence == gap.hi:
+			host.missing[i].hi -= t.Stride
+		default:
+			upper := sequenceRange{lo: sequence + t.Stride, hi: gap.hi}
+			host.missing[i].hi = sequence - t.Stride
+			host.missing = append(host.missing[:i+1], append([]sequenceRange{upper}, host.missing[i+1:]...)...)
+		}
+		return true
+	}
+	return false
+}
+
+// Expected returns the number of pings that should have been received from all hosts
+// based on the range of sequences observed from each host.
+func (t *SequenceTracker) Expected() (expected uint64) {
+	for _, host := range t.hosts {
+		expected += (host.highest-host.first)/t.Stride + 1
+	}
+	return expected
+}
+
+// Received returns the number of distinct pings received from all hosts.
+func (t *SequenceTracker) Received() (received uint64) {
+	for _, host := range t.hosts {
+		received += host.received
+	}
+	return received
+}
+
+// Reordered returns the number of pings from all hosts that arrived out of order.
+func (t *SequenceTracker) Reordered() (reordered uint64) {
+	for _, host := range t.hosts {
+		reordered += host.reordered
+	}
+	return reordered
+}
+
+// Duplicates returns the number of pings from all hosts whose sequence had already
+// been received.
+func (t *SequenceTracker) Duplicates() (duplicates uint64) {
+	for _, host := range t.hosts {
+		duplicates += host.duplicates
+	}
+	return duplicates
+}
+
+// Lost returns the number of expected pings that have not been received.
+func (t *SequenceTracker) Lost() uint64 {
+	expected, received := t.Expected(), t.Received()
+	if received >= expected {
+		return 0
+	}
+	return expected - received
+}
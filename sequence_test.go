@@ -0,0 +1,75 @@
+package sonar_test
+
+import (
+	"testing"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	tests := []struct {
+		name       string
+		stride     uint64
+		sequences  []uint64
+		expected   uint64
+		received   uint64
+		lost       uint64
+		reordered  uint64
+		duplicates uint64
+	}{
+		{"in order", 1, []uint64{1, 2, 3, 4, 5}, 5, 5, 0, 0, 0},
+		{"gap", 1, []uint64{1, 2, 5}, 5, 3, 2, 0, 0},
+		{"reordered", 1, []uint64{1, 3, 2, 4}, 4, 4, 0, 1, 0},
+		{"duplicates do not hide gaps", 1, []uint64{1, 2, 2, 2, 5}, 5, 3, 2, 0, 2},
+		{"duplicate of reordered", 1, []uint64{1, 4, 2, 2, 3}, 4, 4, 0, 2, 1},
+		{"duplicate of highest", 1, []uint64{1, 2, 3, 3}, 3, 3, 0, 0, 1},
+		{"before first", 1, []uint64{5, 6, 2, 3}, 5, 4, 1, 2, 0},
+		{"split gap", 1, []uint64{1, 10, 5, 5, 4, 6}, 10, 5, 5, 3, 1},
+		{"stride", 3, []uint64{1, 4, 13, 7, 7}, 5, 4, 1, 1, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			seqs := sonar.NewSequenceTracker(tc.stride)
+			for _, seq := range tc.sequences {
+				seqs.Track(&sonar.Ping{Hostname: "sender", Sequence: seq})
+			}
+
+			if got := seqs.Expected(); got != tc.expected {
+				t.Errorf("expected %d expected pings, got %d", tc.expected, got)
+			}
+
+			if got := seqs.Received(); got != tc.received {
+				t.Errorf("expected %d received pings, got %d", tc.received, got)
+			}
+
+			if got := seqs.Lost(); got != tc.lost {
+				t.Errorf("expected %d lost pings, got %d", tc.lost, got)
+			}
+
+			if got := seqs.Reordered(); got != tc.reordered {
+				t.Errorf("expected %d reordered pings, got %d", tc.reordered, got)
+			}
+
+			if got := seqs.Duplicates(); got != tc.duplicates {
+				t.Errorf("expected %d duplicate pings, got %d", tc.duplicates, got)
+			}
+		})
+	}
+}
+
+func TestSequenceTrackerHosts(t *testing.T) {
+	seqs := sonar.NewSequenceTracker(1)
+	if _, _, _, duplicate := seqs.Track(&sonar.Ping{Hostname: "a", Sequence: 1}); duplicate {
+		t.Fatal("first ping from a host is not a duplicate")
+	}
+
+	if _, _, _, duplicate := seqs.Track(&sonar.Ping{Hostname: "b", Sequence: 1}); duplicate {
+		t.Fatal("the same sequence from another host is not a duplicate")
+	}
+
+	expected, lost, reordered, duplicate := seqs.Track(&sonar.Ping{Hostname: "a", Sequence: 3})
+	if expected != 2 || lost != 1 || reordered || duplicate {
+		t.Fatalf("unexpected gap result: expected=%d lost=%d reordered=%t duplicate=%t", expected, lost, reordered, duplicate)
+	}
+}
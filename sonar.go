@@ -1,14 +1,23 @@
 package sonar
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
 	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rotationalio/go-ensign"
 	api "github.com/rotationalio/go-ensign/api/v1beta1"
-	mimetype "github.com/rotationalio/go-ensign/mimetype/v1beta1"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -16,46 +25,249 @@ const (
 	Mimetype   = "application/msgpack"
 	DefaultTTL = 750 * time.Millisecond
 	SchemaName = "ping"
+
+	// MaxClockSkew is the tolerance for timestamps from a sender whose clock is ahead.
+	MaxClockSkew = 2 * time.Second
+)
+
+var (
+	ErrNoSequence         = errors.New("ping sequence must be greater than zero")
+	ErrNoTimestamp        = errors.New("ping timestamp is not set")
+	ErrFutureTimestamp    = errors.New("ping timestamp is in the future")
+	ErrInvalidTTL         = errors.New("ping ttl must be positive")
+	ErrReceivedBeforeSent = errors.New("ping was received before it was sent")
 )
 
 type Ping struct {
-	Sequence  uint64        `msgpack:"sequence"`
-	Hostname  string        `msgpack:"hostname"`
-	IPAddress string        `msgpack:"ipaddr"`
-	TTL       time.Duration `msgpack:"ttl"`
-	Timestamp time.Time     `msgpack:"timestamp"`
-	NBytes    int           `msgpack:"-"`
-	Received  time.Time     `msgpack:"-"`
+	Sequence  uint64            `msgpack:"sequence" json:"sequence"`
+	Hostname  string            `msgpack:"hostname" json:"hostname"`
+	IPAddress string            `msgpack:"ipaddr" json:"ipaddr"`
+	TTL       time.Duration     `msgpack:"ttl" json:"ttl"`
+	Timestamp time.Time         `msgpack:"timestamp" json:"timestamp"`
+	Token     string            `msgpack:"token,omitempty" json:"token,omitempty"`
+	Farewell  bool              `msgpack:"farewell,omitempty" json:"farewell,omitempty"`
+	Meta      map[string]string `msgpack:"meta,omitempty" json:"meta,omitempty"`
+	Marker    string            `msgpack:"marker,omitempty" json:"marker,omitempty"`
+	Padding   []byte            `msgpack:"pad,omitempty" json:"pad,omitempty"` // excluded from String() but included in Size()
+	Echoed    bool              `msgpack:"echoed,omitempty" json:"echoed,omitempty"`
+	NBytes    int               `msgpack:"-" json:"-"`
+	Received  time.Time         `msgpack:"-" json:"-"`
+	created   time.Time         // includes the monotonic clock reading, never serialized
+}
+
+// The event type of every ping, which is immutable for the version of the package.
+var schema = &api.Type{
+	Name:         SchemaName,
+	MajorVersion: VersionMajor,
+	MinorVersion: VersionMinor,
+	PatchVersion: VersionPatch,
+}
+
+// Pools of pings and msgpack encoders that are reused to reduce allocation churn.
+var (
+	pings    = sync.Pool{New: func() interface{} { return &Ping{} }}
+	encoders = sync.Pool{New: func() interface{} { return newEncoder() }}
+)
+
+type encoder struct {
+	*msgpack.Encoder
+	buf bytes.Buffer
+}
+
+func newEncoder() *encoder {
+	enc := &encoder{}
+	enc.Encoder = msgpack.NewEncoder(&enc.buf)
+	return enc
 }
 
 type Sonar struct {
-	sequence uint64
+	sequence uint64 // the next sequence number to issue
+	stride   uint64
+	size     int // requested ping size in bytes, used to compute the template padding
 	template Ping
 }
 
-func New() *Sonar {
-	return &Sonar{
+// Option configures the ping template of a Sonar.
+type Option func(s *Sonar)
+
+// WithHostname overrides the detected hostname of the sender, e.g. to label pings with
+// a logical service name rather than a container ID.
+func WithHostname(hostname string) Option {
+	return func(s *Sonar) {
+		s.template.Hostname = hostname
+	}
+}
+
+// WithIPAddress overrides the detected outbound ip address of the sender.
+func WithIPAddress(ipaddr string) Option {
+	return func(s *Sonar) {
+		s.template.IPAddress = ipaddr
+	}
+}
+
+// Hostname returns the hostname stamped on the pings.
+func (s *Sonar) Hostname() string {
+	return s.template.Hostname
+}
+
+// WithToken stamps every ping with a correlation token so that listeners can filter
+// out pings from unrelated runs sharing the same topic.
+func WithToken(token string) Option {
+	return func(s *Sonar) {
+		s.template.Token = token
+	}
+}
+
+// WithMarker embeds a known marker in every ping so that a consumer can confirm that
+// it received and decoded the exact payload that was sent.
+func WithMarker(marker string) Option {
+	return func(s *Sonar) {
+		s.template.Marker = marker
+	}
+}
+
+// WithStartSequence sets the sequence number of the first ping (by default 1).
+func WithStartSequence(start uint64) Option {
+	return func(s *Sonar) {
+		s.sequence = start
+	}
+}
+
+// WithStride sets the increment between sequence numbers so that multiple publishers
+// can interleave on a topic without collisions, e.g. with a stride of 3 publishers can
+// start at 1, 2, and 3 respectively. A stride of zero is ignored.
+func WithStride(stride uint64) Option {
+	return func(s *Sonar) {
+		if stride > 0 {
+			s.stride = stride
+		}
+	}
+}
+
+// WithMeta tags every ping with the key/value metadata, e.g. the region or environment.
+func WithMeta(meta map[string]string) Option {
+	return func(s *Sonar) {
+		s.template.Meta = meta
+	}
+}
+
+// WithTTL sets the time to live of every ping (by default DefaultTTL). Listeners flag
+// pings that are received after their TTL as expired.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Sonar) {
+		s.template.TTL = ttl
+	}
+}
+
+// WithSize pads every ping so that its marshaled size is approximately size bytes,
+// e.g. to probe how the system behaves with larger events. If the ping is already
+// larger than size, no padding is added.
+func WithSize(size int) Option {
+	return func(s *Sonar) {
+		s.size = size
+	}
+}
+
+func New(opts ...Option) *Sonar {
+	s := &Sonar{
+		sequence: 1,
+		stride:   1,
 		template: Ping{
-			Hostname:  Hostname(),
-			IPAddress: GetOutboundIP().String(),
-			TTL:       DefaultTTL,
+			Hostname: Hostname(),
+			TTL:      DefaultTTL,
 		},
 	}
+
+	// If the outbound ip cannot be detected, pings are sent without an ip address.
+	if ip, err := GetOutboundIP(); err == nil {
+		s.template.IPAddress = ip.String()
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// Padding is computed after all options are applied since the size of the ping
+	// depends on the template fields.
+	if s.size > 0 {
+		s.template.Padding = s.padding()
+	}
+	return s
+}
+
+// NewWithTTL creates a Sonar whose pings have the specified time to live.
+func NewWithTTL(ttl time.Duration, opts ...Option) *Sonar {
+	return New(append(opts, WithTTL(ttl))...)
+}
+
+// Compute the padding that brings a ping from the template to the requested size. The
+// size of the padding header depends on the length of the padding, so the length is
+// adjusted once after the first estimate. Sequences grow over time so the resulting
+// size is approximate.
+func (s *Sonar) padding() []byte {
+	sample := s.Next()
+	atomic.AddUint64(&s.sequence, -s.stride)
+
+	sample.Padding = nil
+	n := s.size - sample.Size()
+	if n <= 0 {
+		return nil
+	}
+
+	sample.Padding, sample.NBytes = make([]byte, n), 0
+	if n -= sample.Size() - s.size; n <= 0 {
+		return nil
+	}
+	return make([]byte, n)
 }
 
+// Next returns the next ping from the template. It is safe to call Next concurrently
+// from multiple goroutines; every call returns a unique sequence number.
 func (s *Sonar) Next() *Ping {
-	s.sequence++
-	return &Ping{
-		Sequence:  s.sequence,
+	sequence := atomic.AddUint64(&s.sequence, s.stride) - s.stride
+	now := time.Now()
+	ping := pings.Get().(*Ping)
+	*ping = Ping{
+		Sequence:  sequence,
 		Hostname:  s.template.Hostname,
 		IPAddress: s.template.IPAddress,
 		TTL:       s.template.TTL,
-		Timestamp: time.Now().Truncate(0),
+		Timestamp: now.Truncate(0),
+		Token:     s.template.Token,
+		Meta:      s.template.Meta,
+		Marker:    s.template.Marker,
+		Padding:   s.template.Padding,
+		created:   now,
 	}
+	return ping
+}
+
+// Farewell returns the next ping marked as the final ping from this sender, so that
+// listeners know the sender stopped intentionally rather than crashed.
+func (s *Sonar) Farewell() *Ping {
+	ping := s.Next()
+	ping.Farewell = true
+	return ping
 }
 
-func (p *Ping) Marshal() ([]byte, error) {
-	return msgpack.Marshal(p)
+// Release returns the ping to the pool that Next allocates pings from to reduce
+// allocations when publishing at high rates. The ping must not be used once released.
+func (p *Ping) Release() {
+	*p = Ping{}
+	pings.Put(p)
+}
+
+// Marshal the ping with msgpack using a pooled encoder and buffer; the returned data is
+// a copy that is owned by the caller.
+func (p *Ping) Marshal() (_ []byte, err error) {
+	enc := encoders.Get().(*encoder)
+	defer encoders.Put(enc)
+
+	enc.buf.Reset()
+	if err = enc.Encode(p); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), enc.buf.Bytes()...), nil
 }
 
 func (p *Ping) Unmarshal(data []byte) error {
@@ -64,20 +276,165 @@ func (p *Ping) Unmarshal(data []byte) error {
 	return msgpack.Unmarshal(data, p)
 }
 
-func (p *Ping) Event() *ensign.Event {
+// Event creates an ensign event for the ping encoded with the specified codec. The
+// event type is shared by all ping events and must not be modified.
+func (p *Ping) Event(codec Codec) (_ *ensign.Event, err error) {
 	event := &ensign.Event{
-		Mimetype: mimetype.MustParse(Mimetype),
-		Type: &api.Type{
-			Name:         SchemaName,
-			MajorVersion: VersionMajor,
-			MinorVersion: VersionMinor,
-			PatchVersion: VersionPatch,
-		},
-		Created: time.Now(),
+		Mimetype: codec.Mimetype(),
+		Type:     schema,
+		Created:  time.Now(),
 	}
 
-	event.Data, _ = p.Marshal()
-	return event
+	if event.Data, err = codec.Marshal(p); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Reply returns a copy of the ping to be echoed back to its sender by a responder. The
+// sequence identifies the original ping so the sender can correlate the reply and the
+// hostname identifies the sender: every sender reads the same reply topic and ignores
+// replies to other hostnames. The reply is stamped with the time it was created.
+func (p *Ping) Reply() *Ping {
+	now := time.Now()
+	return &Ping{
+		Sequence:  p.Sequence,
+		Hostname:  p.Hostname,
+		IPAddress: p.IPAddress,
+		TTL:       p.TTL,
+		Timestamp: now.Truncate(0),
+		Token:     p.Token,
+		Meta:      p.Meta,
+		Marker:    p.Marker,
+		Padding:   p.Padding,
+		Echoed:    true,
+		created:   now,
+	}
+}
+
+// MatchesAny returns true if the ping's hostname or ip address matches any of the
+// filters, which are either exact values or simple globs such as *.example.com or
+// 10.0.*. An empty list of filters matches every ping.
+func (p *Ping) MatchesAny(filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+
+	for _, filter := range filters {
+		for _, value := range []string{p.Hostname, p.IPAddress} {
+			if value == "" {
+				continue
+			}
+
+			if value == filter {
+				return true
+			}
+
+			if matched, err := path.Match(filter, value); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate checks the invariants of a received ping: it must have a sequence, a
+// timestamp that is not in the future (allowing for MaxClockSkew), a positive TTL, and
+// if it has been received, it must not have been received before it was sent.
+func (p *Ping) Validate() error {
+	if p.Sequence == 0 {
+		return ErrNoSequence
+	}
+
+	if p.Timestamp.IsZero() {
+		return ErrNoTimestamp
+	}
+
+	if p.Timestamp.After(time.Now().Add(MaxClockSkew)) {
+		return ErrFutureTimestamp
+	}
+
+	if p.TTL <= 0 {
+		return ErrInvalidTTL
+	}
+
+	if !p.Received.IsZero() && p.Received.Before(p.Timestamp.Add(-MaxClockSkew)) {
+		return ErrReceivedBeforeSent
+	}
+	return nil
+}
+
+// Equal returns true if the pings have the same wire fields, e.g. to check that a ping
+// round-tripped through the broker. Fields set when a ping is received such as NBytes
+// and Received are ignored.
+func (p *Ping) Equal(other *Ping) bool {
+	return p.Diff(other) == ""
+}
+
+// Diff describes the wire fields that differ between the pings, one per line, or
+// returns an empty string if the pings are equal.
+func (p *Ping) Diff(other *Ping) string {
+	var diffs []string
+	field := func(name string, equal bool, a, b interface{}) {
+		if !equal {
+			diffs = append(diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+		}
+	}
+
+	field("sequence", p.Sequence == other.Sequence, p.Sequence, other.Sequence)
+	field("hostname", p.Hostname == other.Hostname, p.Hostname, other.Hostname)
+	field("ipaddr", p.IPAddress == other.IPAddress, p.IPAddress, other.IPAddress)
+	field("ttl", p.TTL == other.TTL, p.TTL, other.TTL)
+	field("timestamp", p.Timestamp.Equal(other.Timestamp), p.Timestamp, other.Timestamp)
+	field("token", p.Token == other.Token, p.Token, other.Token)
+	field("farewell", p.Farewell == other.Farewell, p.Farewell, other.Farewell)
+	field("meta", equalMeta(p.Meta, other.Meta), p.Meta, other.Meta)
+	field("marker", p.Marker == other.Marker, p.Marker, other.Marker)
+	field("pad", bytes.Equal(p.Padding, other.Padding), fmt.Sprintf("%d bytes", len(p.Padding)), fmt.Sprintf("%d bytes", len(other.Padding)))
+	field("echoed", p.Echoed == other.Echoed, p.Echoed, other.Echoed)
+	return strings.Join(diffs, "\n")
+}
+
+// Metadata is omitted from the wire when empty, so nil and empty metadata are equal.
+func equalMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, val := range a {
+		if other, ok := b[key]; !ok || other != val {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalJSON serializes the ping with its receive-side fields and the computed time
+// delta so that received pings can be written as JSON lines.
+func (p *Ping) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Sequence  uint64            `json:"sequence"`
+		Hostname  string            `json:"hostname"`
+		IPAddress string            `json:"ipaddr"`
+		TTL       float64           `json:"ttl_ms"`
+		Timestamp time.Time         `json:"timestamp"`
+		Received  time.Time         `json:"received"`
+		NBytes    int               `json:"nbytes"`
+		Timedelta float64           `json:"timedelta_ms"`
+		Expired   bool              `json:"expired,omitempty"`
+		Meta      map[string]string `json:"meta,omitempty"`
+	}{
+		Sequence:  p.Sequence,
+		Hostname:  p.Hostname,
+		IPAddress: p.IPAddress,
+		TTL:       float64(p.TTL) / float64(time.Millisecond),
+		Timestamp: p.Timestamp,
+		Received:  p.Received,
+		NBytes:    p.Size(),
+		Timedelta: float64(p.Timedelta()) / float64(time.Millisecond),
+		Expired:   p.Expired(),
+		Meta:      p.Meta,
+	})
 }
 
 func (p *Ping) String() string {
@@ -93,9 +450,39 @@ func (p *Ping) String() string {
 		sender = "unknown"
 	}
 
-	return fmt.Sprintf("%d bytes from %s: seq=%d ttl=%s time=%s", p.Size(), sender, p.Sequence, p.TTL, p.Timedelta())
+	out := fmt.Sprintf("%d bytes from %s: seq=%d ttl=%s time=%s", p.Size(), sender, p.Sequence, p.TTL, p.Timedelta())
+	if len(p.Meta) > 0 {
+		keys := make([]string, 0, len(p.Meta))
+		for key := range p.Meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key+"="+p.Meta[key])
+		}
+		out += " meta=" + strings.Join(pairs, ",")
+	}
+
+	if p.Expired() {
+		out += " (EXPIRED)"
+	}
+
+	if p.Farewell {
+		out += " (farewell)"
+	}
+
+	if p.Echoed {
+		out += " (reply)"
+	}
+	return out
 }
 
+// Size returns the number of bytes of the ping. For received pings this is the length
+// of the event data recorded by Unmarshal. Otherwise the ping is marshaled once and the
+// size is cached, so it is not updated if the ping's fields are later modified; use
+// WireSize to get the current size.
 func (p *Ping) Size() int {
 	if p.NBytes == 0 {
 		data, _ := p.Marshal()
@@ -104,6 +491,16 @@ func (p *Ping) Size() int {
 	return p.NBytes
 }
 
+// WireSize always marshals the ping with msgpack and returns the exact number of bytes
+// that would be sent on the wire without updating the cached Size.
+func (p *Ping) WireSize() (int, error) {
+	data, err := p.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
 func (p *Ping) Timedelta() time.Duration {
 	if p.Received.IsZero() {
 		p.Received = time.Now()
@@ -111,16 +508,316 @@ func (p *Ping) Timedelta() time.Duration {
 	return p.Received.Sub(p.Timestamp)
 }
 
-// Get preferred outbound ip of this machine
-func GetOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return nil
+// Expired returns true if the ping arrived after its TTL elapsed; pings without a TTL
+// never expire.
+func (p *Ping) Expired() bool {
+	return p.TTL > 0 && p.Timedelta() > p.TTL
+}
+
+// Age returns the time since the ping was sent. Unlike Timedelta, which is fixed when
+// the ping is received, the age is relative to now, so it keeps growing while a ping
+// waits to be processed, e.g. when a consumer is draining a backlog.
+func (p *Ping) Age() time.Duration {
+	return time.Since(p.Timestamp)
+}
+
+// Elapsed returns the time since the ping was created using the monotonic clock if the
+// ping was created in this process (e.g. by Sonar.Next), which is not affected by wall
+// clock adjustments. Pings decoded from events do not have a monotonic reading, so
+// Elapsed falls back to Timedelta. Use Timedelta for one-way latency between hosts,
+// which is only as accurate as the synchronization of their clocks, and Elapsed for
+// durations measured by a single process such as a round trip.
+func (p *Ping) Elapsed() time.Duration {
+	switch {
+	case p.created.IsZero():
+		return p.Timedelta()
+	case p.Received.IsZero():
+		return time.Since(p.created)
+	default:
+		return p.Received.Sub(p.created)
+	}
+}
+
+// Stats accumulates the number of pings transmitted and received along with the
+// distribution of their latencies, similar to the statistics printed by ping.
+type Stats struct {
+	Transmitted uint64
+	Received    uint64
+	Expired     uint64 // received after their TTL
+	count       uint64
+	sum         float64
+	sumsq       float64
+	min         time.Duration
+	max         time.Duration
+}
+
+// Observe records a latency observation.
+func (s *Stats) Observe(d time.Duration) {
+	if s.count == 0 || d < s.min {
+		s.min = d
+	}
+	if s.count == 0 || d > s.max {
+		s.max = d
+	}
+
+	s.count++
+	s.sum += float64(d)
+	s.sumsq += float64(d) * float64(d)
+}
+
+// Count returns the number of latency observations.
+func (s *Stats) Count() uint64 {
+	return s.count
+}
+
+func (s *Stats) Min() time.Duration {
+	return s.min
+}
+
+func (s *Stats) Max() time.Duration {
+	return s.max
+}
+
+func (s *Stats) Mean() time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	return time.Duration(s.sum / float64(s.count))
+}
+
+func (s *Stats) StdDev() time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+
+	mean := s.sum / float64(s.count)
+	variance := s.sumsq/float64(s.count) - mean*mean
+	if variance <= 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(variance))
+}
+
+// Loss returns the percentage of transmitted pings that were not received.
+func (s *Stats) Loss() float64 {
+	if s.Transmitted == 0 || s.Received >= s.Transmitted {
+		return 0
+	}
+	return float64(s.Transmitted-s.Received) / float64(s.Transmitted) * 100
+}
+
+// Summary returns the counts, loss, and latency distribution in the style of ping.
+func (s *Stats) Summary() string {
+	var out string
+	if s.Transmitted > 0 {
+		out = fmt.Sprintf("%d pings transmitted, %d received, %0.1f%% loss", s.Transmitted, s.Received, s.Loss())
+	} else {
+		out = fmt.Sprintf("%d pings received", s.Received)
+	}
+
+	if s.Expired > 0 {
+		out += fmt.Sprintf(", %d expired", s.Expired)
+	}
+
+	if s.count > 0 {
+		ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		out += fmt.Sprintf("\nlatency min/avg/max/mdev = %0.3f/%0.3f/%0.3f/%0.3f ms", ms(s.min), ms(s.Mean()), ms(s.max), ms(s.StdDev()))
+	}
+	return out
+}
+
+// DefaultHistogramBounds are the upper bounds of the default latency buckets.
+var DefaultHistogramBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// Width of the longest bar in the histogram chart.
+const histogramBarWidth = 40
+
+// Histogram counts latencies in buckets defined by increasing upper bounds, with a
+// final bucket for latencies at or above the last bound.
+type Histogram struct {
+	Bounds []time.Duration
+	counts []uint64
+}
+
+// NewHistogram creates a histogram with the specified increasing bucket bounds or the
+// default bounds if none are specified.
+func NewHistogram(bounds ...time.Duration) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultHistogramBounds
+	}
+	return &Histogram{Bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe counts the latency in its bucket.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return d < h.Bounds[i] })
+	h.counts[i]++
+}
+
+// Counts returns the number of observations in each bucket.
+func (h *Histogram) Counts() []uint64 {
+	return h.counts
+}
+
+// String renders the histogram as an ASCII bar chart with one bucket per line.
+func (h *Histogram) String() string {
+	labels := make([]string, len(h.counts))
+	for i := range h.counts {
+		switch {
+		case i == 0:
+			labels[i] = fmt.Sprintf("<%s", h.Bounds[0])
+		case i == len(h.Bounds):
+			labels[i] = fmt.Sprintf("%s+", h.Bounds[i-1])
+		default:
+			labels[i] = fmt.Sprintf("%s-%s", h.Bounds[i-1], h.Bounds[i])
+		}
+	}
+
+	var width int
+	var most uint64
+	for i, count := range h.counts {
+		if len(labels[i]) > width {
+			width = len(labels[i])
+		}
+		if count > most {
+			most = count
+		}
+	}
+
+	var out strings.Builder
+	for i, count := range h.counts {
+		var bar int
+		if most > 0 {
+			bar = int(count * histogramBarWidth / most)
+		}
+		fmt.Fprintf(&out, "%*s | %-*s %d\n", width, labels[i], histogramBarWidth, strings.Repeat("#", bar), count)
+	}
+	return out.String()
+}
+
+// DefaultSampleSize is the default number of latencies kept to compute percentiles.
+const DefaultSampleSize = 10000
+
+// Percentiles estimates the quantiles of the latency distribution from a uniform random
+// sample of the observed latencies. The sample is a fixed size reservoir so memory is
+// bounded on very long runs; until the reservoir is full the quantiles are exact.
+type Percentiles struct {
+	size    int
+	count   uint64
+	samples []time.Duration
+	sorted  bool
+	rng     *rand.Rand
+}
+
+// NewPercentiles creates a percentile estimator that keeps at most size samples; if
+// size is not positive the DefaultSampleSize is used.
+func NewPercentiles(size int) *Percentiles {
+	if size <= 0 {
+		size = DefaultSampleSize
+	}
+
+	return &Percentiles{
+		size:    size,
+		samples: make([]time.Duration, 0, size),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add a latency to the sample. Once the reservoir is full, each new latency replaces a
+// random sample with probability size/count so every latency is equally likely to be kept.
+func (p *Percentiles) Add(d time.Duration) {
+	p.count++
+	p.sorted = false
+
+	if len(p.samples) < p.size {
+		p.samples = append(p.samples, d)
+		return
+	}
+
+	if i := p.rng.Int63n(int64(p.count)); i < int64(p.size) {
+		p.samples[i] = d
+	}
+}
+
+// Count returns the number of latencies added, which may be more than are sampled.
+func (p *Percentiles) Count() uint64 {
+	return p.count
+}
+
+// Quantile returns the latency at the quantile q between 0 and 1, linearly
+// interpolating between the closest ranks of the sample. Zero is returned if no
+// latencies have been added.
+func (p *Percentiles) Quantile(q float64) time.Duration {
+	if len(p.samples) == 0 {
+		return 0
+	}
+
+	if !p.sorted {
+		sort.Slice(p.samples, func(i, j int) bool { return p.samples[i] < p.samples[j] })
+		p.sorted = true
+	}
+
+	switch {
+	case q <= 0:
+		return p.samples[0]
+	case q >= 1:
+		return p.samples[len(p.samples)-1]
+	}
+
+	rank := q * float64(len(p.samples)-1)
+	lo := int(rank)
+	if lo+1 >= len(p.samples) {
+		return p.samples[lo]
+	}
+
+	frac := rank - float64(lo)
+	return p.samples[lo] + time.Duration(frac*float64(p.samples[lo+1]-p.samples[lo]))
+}
+
+// String returns the p50, p90, p95, and p99 latencies in milliseconds.
+func (p *Percentiles) String() string {
+	ms := func(q float64) float64 { return float64(p.Quantile(q)) / float64(time.Millisecond) }
+	return fmt.Sprintf("latency p50/p90/p95/p99 = %0.3f/%0.3f/%0.3f/%0.3f ms", ms(0.5), ms(0.9), ms(0.95), ms(0.99))
+}
+
+// Default targets used to detect the outbound ip address; no packets are sent since the
+// address is determined by dialing a UDP socket.
+const (
+	OutboundTargetIPv4 = "8.8.8.8:80"
+	OutboundTargetIPv6 = "[2001:4860:4860::8888]:80"
+)
+
+// GetOutboundIP returns the preferred outbound ip of this machine, falling back to IPv6
+// if an IPv4 route is not available (e.g. on IPv6-only hosts).
+func GetOutboundIP() (ip net.IP, err error) {
+	if ip, err = GetOutboundIPFor(OutboundTargetIPv4); err == nil {
+		return ip, nil
+	}
+
+	var err6 error
+	if ip, err6 = GetOutboundIPFor(OutboundTargetIPv6); err6 == nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("could not detect outbound ip: %v; %v", err, err6)
+}
+
+// GetOutboundIPFor returns the local ip address used to route to the target host:port,
+// which can be set to a reachable address in air-gapped environments.
+func GetOutboundIPFor(target string) (_ net.IP, err error) {
+	var conn net.Conn
+	if conn, err = net.Dial("udp", target); err != nil {
+		return nil, err
 	}
 	defer conn.Close()
 
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP
+	return localAddr.IP, nil
 }
 
 func Hostname() string {
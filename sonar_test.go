@@ -0,0 +1,315 @@
+package sonar_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestNextConcurrent(t *testing.T) {
+	const (
+		routines = 50
+		calls    = 1000
+	)
+
+	s := sonar.New()
+	results := make([][]uint64, routines)
+
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = make([]uint64, 0, calls)
+			for j := 0; j < calls; j++ {
+				ping := s.Next()
+				results[i] = append(results[i], ping.Sequence)
+				ping.Release()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]struct{}, routines*calls)
+	for _, sequences := range results {
+		for _, seq := range sequences {
+			if _, ok := seen[seq]; ok {
+				t.Fatalf("sequence %d was issued more than once", seq)
+			}
+			seen[seq] = struct{}{}
+		}
+	}
+
+	if len(seen) != routines*calls {
+		t.Fatalf("expected %d distinct sequences, got %d", routines*calls, len(seen))
+	}
+
+	for seq := uint64(1); seq <= routines*calls; seq++ {
+		if _, ok := seen[seq]; !ok {
+			t.Fatalf("sequence %d was not issued", seq)
+		}
+	}
+}
+
+func TestNextAfterRelease(t *testing.T) {
+	// Pings are pooled, so a ping from Next must not keep the fields of a released ping.
+	s := sonar.New()
+	for i := 0; i < 100; i++ {
+		ping := s.Next()
+		if ping.Farewell || ping.Echoed || ping.NBytes != 0 || !ping.Received.IsZero() {
+			t.Fatalf("ping %d has fields from a released ping: %+v", ping.Sequence, ping)
+		}
+
+		ping.Farewell, ping.Echoed, ping.NBytes = true, true, 42
+		ping.Received = ping.Timestamp
+		ping.Release()
+	}
+}
+
+func TestNextStride(t *testing.T) {
+	s := sonar.New(sonar.WithStartSequence(2), sonar.WithStride(3))
+	for _, expected := range []uint64{2, 5, 8, 11, 14} {
+		ping := s.Next()
+		if ping.Sequence != expected {
+			t.Fatalf("expected sequence %d, got %d", expected, ping.Sequence)
+		}
+
+		if err := ping.Validate(); err != nil {
+			t.Errorf("expected ping %d to be valid: %s", ping.Sequence, err)
+		}
+		ping.Release()
+	}
+}
+
+func TestWithMarker(t *testing.T) {
+	s := sonar.New(sonar.WithMarker("canary"))
+	for _, ping := range []*sonar.Ping{s.Next(), s.Farewell(), s.Next().Reply()} {
+		if ping.Marker != "canary" {
+			t.Errorf("expected ping %d to carry the marker, got %q", ping.Sequence, ping.Marker)
+		}
+	}
+
+	// A consumer compares the decoded marker with the expected marker.
+	ping := s.Next()
+	defer ping.Release()
+
+	other := *ping
+	other.Marker = "other"
+	if ping.Equal(&other) {
+		t.Error("expected pings with different markers not to be equal")
+	}
+
+	if ping = sonar.New().Next(); ping.Marker != "" {
+		t.Errorf("expected no marker by default, got %q", ping.Marker)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	valid := func() *sonar.Ping {
+		return &sonar.Ping{Sequence: 1, TTL: sonar.DefaultTTL, Timestamp: now, Received: now.Add(time.Millisecond)}
+	}
+
+	tests := []struct {
+		name string
+		edit func(*sonar.Ping)
+		err  error
+	}{
+		{"valid", func(*sonar.Ping) {}, nil},
+		{"not received", func(p *sonar.Ping) { p.Received = time.Time{} }, nil},
+		{"no sequence", func(p *sonar.Ping) { p.Sequence = 0 }, sonar.ErrNoSequence},
+		{"no timestamp", func(p *sonar.Ping) { p.Timestamp = time.Time{} }, sonar.ErrNoTimestamp},
+		{"future timestamp", func(p *sonar.Ping) { p.Timestamp = now.Add(sonar.MaxClockSkew + time.Minute) }, sonar.ErrFutureTimestamp},
+		{"within clock skew", func(p *sonar.Ping) { p.Timestamp = now.Add(sonar.MaxClockSkew / 2) }, nil},
+		{"zero ttl", func(p *sonar.Ping) { p.TTL = 0 }, sonar.ErrInvalidTTL},
+		{"negative ttl", func(p *sonar.Ping) { p.TTL = -time.Second }, sonar.ErrInvalidTTL},
+		{"received before sent", func(p *sonar.Ping) { p.Received = now.Add(-sonar.MaxClockSkew - time.Second) }, sonar.ErrReceivedBeforeSent},
+		{"received within clock skew", func(p *sonar.Ping) { p.Received = now.Add(-sonar.MaxClockSkew / 2) }, nil},
+	}
+
+	for _, tc := range tests {
+		ping := valid()
+		tc.edit(ping)
+		if err := ping.Validate(); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	s := sonar.New()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Next().Release()
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	ping := sonar.New().Next()
+	defer ping.Release()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ping.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEvent(b *testing.B) {
+	s := sonar.New()
+	codec := sonar.MsgPackCodec{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ping := s.Next()
+		if _, err := ping.Event(codec); err != nil {
+			b.Fatal(err)
+		}
+		ping.Release()
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	p := sonar.NewPercentiles(0)
+	if q := p.Quantile(0.5); q != 0 {
+		t.Fatalf("expected zero quantile with no samples, got %s", q)
+	}
+
+	// Add 1..100ms in a shuffled order; the quantiles of a uniform distribution are
+	// interpolated between the closest ranks (allowing for floating point rounding).
+	for i := 0; i < 100; i++ {
+		p.Add(time.Duration((i*37)%100+1) * time.Millisecond)
+	}
+
+	tests := []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, 50500 * time.Microsecond},
+		{0.9, 90100 * time.Microsecond},
+		{0.95, 95050 * time.Microsecond},
+		{0.99, 99010 * time.Microsecond},
+		{1, 100 * time.Millisecond},
+	}
+
+	for _, tc := range tests {
+		if got := p.Quantile(tc.q); got < tc.expected-time.Microsecond || got > tc.expected+time.Microsecond {
+			t.Errorf("expected p%0.0f to be %s, got %s", tc.q*100, tc.expected, got)
+		}
+	}
+
+	if p.Count() != 100 {
+		t.Errorf("expected 100 latencies, got %d", p.Count())
+	}
+}
+
+func TestPercentilesReservoir(t *testing.T) {
+	// The reservoir is bounded but remains a uniform sample of the latencies, so the
+	// estimated quantiles of a uniform distribution over 0-999ms are close to exact.
+	p := sonar.NewPercentiles(2000)
+	for i := 0; i < 200000; i++ {
+		p.Add(time.Duration(i%1000) * time.Millisecond)
+	}
+
+	if p.Count() != 200000 {
+		t.Fatalf("expected 200000 latencies, got %d", p.Count())
+	}
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		expected := time.Duration(q * float64(999*time.Millisecond))
+		if got := p.Quantile(q); got < expected-50*time.Millisecond || got > expected+50*time.Millisecond {
+			t.Errorf("expected p%0.0f to be about %s, got %s", q*100, expected, got)
+		}
+	}
+}
+
+func TestReceivedSize(t *testing.T) {
+	seal, err := sonar.NewCipher("secret")
+	if err != nil {
+		t.Fatalf("could not create cipher: %s", err)
+	}
+
+	for _, codec := range []sonar.Codec{sonar.MsgPackCodec{}, sonar.JSONCodec{}} {
+		for _, sealed := range []bool{false, true} {
+			ping := sonar.New(sonar.WithSize(256)).Next()
+			event, err := ping.Event(codec)
+			if err != nil {
+				t.Fatalf("could not create event: %s", err)
+			}
+			ping.Release()
+
+			// The size of a sealed ping is the size of its plaintext, not the ciphertext.
+			nbytes := len(event.Data)
+			if sealed {
+				if err = seal.Seal(event); err != nil {
+					t.Fatalf("could not seal event: %s", err)
+				}
+			}
+
+			received, _, err := sonar.Decode(event, seal)
+			if err != nil {
+				t.Fatalf("could not decode event: %s", err)
+			}
+
+			if received.Size() != nbytes {
+				t.Errorf("expected received %s ping (sealed=%t) size %d, got %d", codec.Mimetype(), sealed, nbytes, received.Size())
+			}
+		}
+	}
+}
+
+func TestWireSize(t *testing.T) {
+	ping := sonar.New().Next()
+	defer ping.Release()
+
+	size := ping.Size()
+	ping.Padding = make([]byte, 128)
+
+	// Size is cached while WireSize always reflects the current fields.
+	if ping.Size() != size {
+		t.Errorf("expected cached size %d, got %d", size, ping.Size())
+	}
+
+	wire, err := ping.WireSize()
+	if err != nil {
+		t.Fatalf("could not compute wire size: %s", err)
+	}
+
+	data, err := ping.Marshal()
+	if err != nil {
+		t.Fatalf("could not marshal ping: %s", err)
+	}
+
+	if wire != len(data) || wire <= size {
+		t.Errorf("expected wire size %d after padding, got %d", len(data), wire)
+	}
+}
+
+func TestAge(t *testing.T) {
+	ping := &sonar.Ping{Timestamp: time.Now().Add(-10 * time.Minute)}
+	if age := ping.Age(); age < 10*time.Minute || age > 11*time.Minute {
+		t.Fatalf("expected a ping sent 10 minutes ago to be about 10m old, got %s", age)
+	}
+
+	// Age is relative to now, unlike Timedelta which is relative to when it was received.
+	ping.Received = ping.Timestamp.Add(time.Second)
+	if delta := ping.Timedelta(); delta != time.Second {
+		t.Errorf("expected a 1s timedelta, got %s", delta)
+	}
+
+	if age := ping.Age(); age < 10*time.Minute {
+		t.Errorf("expected the age to ignore the receive time, got %s", age)
+	}
+
+	fresh := sonar.New().Next()
+	defer fresh.Release()
+	if age := fresh.Age(); age < 0 || age > time.Second {
+		t.Errorf("expected a new ping to be fresh, got %s", age)
+	}
+}
@@ -0,0 +1,516 @@
+/*
+Package sonartest provides an in-memory Ensign broker for testing the ping pipeline
+end to end without connecting to an Ensign server. The broker is served by the go-ensign
+mock over a bufconn, so pings go through the real ensign client and are serialized as
+protocol buffers exactly as they would be on the wire. Published events are routed to
+the subscribers of their topic synchronously, with optional loss, latency, and reorder
+injection to simulate an unreliable broker. Topics can be listed, checked, and created,
+optionally with a delay before created topics exist.
+*/
+package sonartest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/go-ensign"
+	api "github.com/rotationalio/go-ensign/api/v1beta1"
+	"github.com/rotationalio/go-ensign/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	subscriberBuffer = 64
+	reorderWindow    = 10 * time.Millisecond // how long a reordered event waits for the next event
+)
+
+// Broker routes events published to a topic to every subscriber of the topic. Events
+// are acked by the broker once they are routed, even if they were dropped, so loss is
+// only detected by the listeners. Topics must be created before the publisher stream
+// is opened (i.e. before the first publish) to be published to by name.
+type Broker struct {
+	mu        sync.Mutex
+	server    *mock.Ensign
+	topics    map[string]ulid.ULID
+	offsets   map[ulid.ULID]uint64 // number of events published to each topic
+	subs      map[*subscriber]struct{}
+	rand      *rand.Rand
+	loss      float64
+	latency   time.Duration
+	reorder   float64
+	ready     time.Duration // delay before a created topic exists
+	held      *api.EventWrapper
+	flush     *time.Timer
+	published uint64
+	dropped   uint64
+	acked     uint64
+	nacked    uint64
+	done      chan struct{}
+	closing   sync.Once
+}
+
+type subscriber struct {
+	topics map[ulid.ULID]struct{} // all topics if empty
+	events chan *api.EventWrapper
+	done   chan struct{}
+}
+
+// Option configures the Broker.
+type Option func(b *Broker)
+
+// WithTopics creates the topics when the broker is created.
+func WithTopics(names ...string) Option {
+	return func(b *Broker) {
+		for _, name := range names {
+			b.topics[name] = ulid.Make()
+		}
+	}
+}
+
+// WithLoss drops the fraction of published events instead of delivering them.
+func WithLoss(rate float64) Option {
+	return func(b *Broker) {
+		b.loss = rate
+	}
+}
+
+// WithLatency delays each event before it is delivered and acked.
+func WithLatency(latency time.Duration) Option {
+	return func(b *Broker) {
+		b.latency = latency
+	}
+}
+
+// WithReorder delivers the fraction of published events after the event published
+// after them, or after a short delay if no other event is published.
+func WithReorder(rate float64) Option {
+	return func(b *Broker) {
+		b.reorder = rate
+	}
+}
+
+// WithTopicDelay delays created topics from existing until the delay has passed to
+// simulate a broker where topic creation is eventually consistent.
+func WithTopicDelay(delay time.Duration) Option {
+	return func(b *Broker) {
+		b.ready = delay
+	}
+}
+
+// WithSeed seeds the random source used to inject loss and reordering so that a test
+// run is reproducible.
+func WithSeed(seed int64) Option {
+	return func(b *Broker) {
+		b.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// New starts an in-memory broker; Close must be called to stop it.
+func New(opts ...Option) *Broker {
+	b := &Broker{
+		server:  mock.New(nil),
+		topics:  make(map[string]ulid.ULID),
+		offsets: make(map[ulid.ULID]uint64),
+		subs:    make(map[*subscriber]struct{}),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:    make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	b.server.OnPublish = b.publish
+	b.server.OnSubscribe = b.subscribe
+	b.server.OnListTopics = b.listTopics
+	b.server.OnCreateTopic = b.createTopic
+	b.server.OnTopicExists = b.topicExists
+	return b
+}
+
+// Client returns an ensign client connected to the broker.
+func (b *Broker) Client() (*ensign.Client, error) {
+	return ensign.New(ensign.WithMock(b.server))
+}
+
+// Topic returns the ID of the topic, creating the topic if it does not exist.
+func (b *Broker) Topic(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topicID, ok := b.topics[name]
+	if !ok {
+		topicID = ulid.Make()
+		b.topics[name] = topicID
+	}
+	return topicID.String()
+}
+
+// Published returns the number of events published to the broker.
+func (b *Broker) Published() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published
+}
+
+// Dropped returns the number of published events that were not delivered.
+func (b *Broker) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Subscribers returns the number of open subscriber streams, e.g. to wait for a
+// listener to subscribe before publishing.
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Acked returns the number of events acked by subscribers.
+func (b *Broker) Acked() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acked
+}
+
+// Nacked returns the number of events nacked by subscribers.
+func (b *Broker) Nacked() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nacked
+}
+
+// Close stops the broker, closing the streams of all connected clients. The clients do
+// not close their publish streams, so the streams are stopped by the broker rather than
+// waiting for the clients to hang up.
+func (b *Broker) Close() {
+	b.closing.Do(func() {
+		close(b.done)
+
+		b.mu.Lock()
+		if b.flush != nil {
+			b.flush.Stop()
+		}
+		b.mu.Unlock()
+		b.server.Shutdown()
+	})
+}
+
+// Handles a publisher stream, acking every event once it has been routed.
+func (b *Broker) publish(stream api.Ensign_PublishServer) (err error) {
+	var msg *api.PublisherRequest
+	if msg, err = stream.Recv(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	open := msg.GetOpenStream()
+	if open == nil {
+		return status.Error(codes.FailedPrecondition, "expected an open stream message for initialization")
+	}
+
+	ready := &api.StreamReady{ClientId: open.ClientId, ServerId: "sonartest", Topics: b.topicMap()}
+	if err = stream.Send(&api.PublisherReply{Embed: &api.PublisherReply_Ready{Ready: ready}}); err != nil {
+		return err
+	}
+
+	// Events are received in a go routine so that the stream stops when the broker does.
+	requests, closed := make(chan *api.PublisherRequest), make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				closed <- err
+				return
+			}
+
+			select {
+			case requests <- msg:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg = <-requests:
+		case err = <-closed:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-b.done:
+			return nil
+		}
+
+		event := msg.GetEvent()
+		if event == nil {
+			return status.Error(codes.FailedPrecondition, "only events allowed after stream initialization")
+		}
+
+		reply := &api.PublisherReply{Embed: &api.PublisherReply_Ack{Ack: &api.Ack{Id: event.LocalId}}}
+		if err = b.route(event); err != nil {
+			reply.Embed = &api.PublisherReply_Nack{Nack: &api.Nack{Id: event.LocalId, Code: api.Nack_TOPIC_UKNOWN, Error: err.Error()}}
+		}
+
+		if err = stream.Send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// Route a published event to the subscribers of its topic, injecting faults.
+func (b *Broker) route(event *api.EventWrapper) (err error) {
+	var topicID ulid.ULID
+	if err = topicID.UnmarshalBinary(event.TopicId); err != nil {
+		return err
+	}
+
+	if !b.hasTopic(topicID) {
+		return errors.New("unknown topic")
+	}
+
+	if b.latency > 0 {
+		time.Sleep(b.latency)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.published++
+	b.offsets[topicID]++
+	event.Id = ulid.Make().Bytes()
+	event.Offset = b.published
+
+	if b.rand.Float64() < b.loss {
+		b.dropped++
+		return nil
+	}
+
+	// A held event is delivered after the event that overtook it.
+	if b.held != nil {
+		b.flush.Stop()
+		b.deliver(event)
+		b.deliver(b.held)
+		b.held = nil
+		return nil
+	}
+
+	if b.rand.Float64() < b.reorder {
+		b.held = event
+		b.flush = time.AfterFunc(reorderWindow, b.release)
+		return nil
+	}
+
+	b.deliver(event)
+	return nil
+}
+
+// Deliver the held event if no other event overtook it within the reorder window.
+func (b *Broker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.held != nil {
+		b.deliver(b.held)
+		b.held = nil
+	}
+}
+
+// Must be called with the lock held; blocks until every subscriber has buffered the
+// event so that events are delivered in the order they are routed.
+func (b *Broker) deliver(event *api.EventWrapper) {
+	var topicID ulid.ULID
+	topicID.UnmarshalBinary(event.TopicId)
+
+	for sub := range b.subs {
+		if len(sub.topics) > 0 {
+			if _, ok := sub.topics[topicID]; !ok {
+				continue
+			}
+		}
+
+		select {
+		case sub.events <- event:
+		case <-sub.done:
+		}
+	}
+}
+
+// Handles a subscriber stream, sending it the events routed to its topics. Acks and
+// nacks from the subscriber are counted but do not cause events to be redelivered.
+func (b *Broker) subscribe(stream api.Ensign_SubscribeServer) (err error) {
+	var msg *api.SubscribeRequest
+	if msg, err = stream.Recv(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	info := msg.GetSubscription()
+	if info == nil {
+		return status.Error(codes.FailedPrecondition, "expected a subscription message for initialization")
+	}
+
+	sub := &subscriber{
+		topics: make(map[ulid.ULID]struct{}),
+		events: make(chan *api.EventWrapper, subscriberBuffer),
+		done:   make(chan struct{}),
+	}
+
+	// Topics may be subscribed to by name or by ID.
+	topics := b.topicMap()
+	for _, topic := range info.Topics {
+		var topicID ulid.ULID
+		if data, ok := topics[topic]; ok {
+			topicID.UnmarshalBinary(data)
+		} else if topicID, err = ulid.Parse(topic); err != nil || !b.hasTopic(topicID) {
+			return status.Errorf(codes.InvalidArgument, "unknown topic %q", topic)
+		}
+		sub.topics[topicID] = struct{}{}
+	}
+
+	ready := &api.StreamReady{ClientId: info.ClientId, ServerId: "sonartest", Topics: topics}
+	if err = stream.Send(&api.SubscribeReply{Embed: &api.SubscribeReply_Ready{Ready: ready}}); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	// Stop blocking delivery before waiting for the lock to unsubscribe.
+	defer func() {
+		close(sub.done)
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}()
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				closed <- err
+				return
+			}
+
+			b.mu.Lock()
+			switch msg.Embed.(type) {
+			case *api.SubscribeRequest_Ack:
+				b.acked++
+			case *api.SubscribeRequest_Nack:
+				b.nacked++
+			}
+			b.mu.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case event := <-sub.events:
+			if err = stream.Send(&api.SubscribeReply{Embed: &api.SubscribeReply_Event{Event: event}}); err != nil {
+				return err
+			}
+		case err = <-closed:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-b.done:
+			return nil
+		}
+	}
+}
+
+// Lists every topic in a single page sorted by name. Topics are created with one shard
+// at the time of their ID and their offset is the number of events published to them.
+func (b *Broker) listTopics(context.Context, *api.PageInfo) (*api.TopicsPage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	page := &api.TopicsPage{Topics: make([]*api.Topic, 0, len(names))}
+	for _, name := range names {
+		topicID := b.topics[name]
+		page.Topics = append(page.Topics, &api.Topic{
+			Id:      topicID.Bytes(),
+			Name:    name,
+			Offset:  b.offsets[topicID],
+			Shards:  1,
+			Created: timestamppb.New(ulid.Time(topicID.Time())),
+		})
+	}
+	return page, nil
+}
+
+// Creates a topic that exists once the topic delay has passed.
+func (b *Broker) createTopic(_ context.Context, in *api.Topic) (_ *api.Topic, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.topics[in.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "topic %q already exists", in.Name)
+	}
+
+	topicID := ulid.Make()
+	if b.ready > 0 {
+		time.AfterFunc(b.ready, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.topics[in.Name] = topicID
+		})
+	} else {
+		b.topics[in.Name] = topicID
+	}
+
+	return &api.Topic{Id: topicID.Bytes(), Name: in.Name, Shards: 1, Created: timestamppb.New(ulid.Time(topicID.Time()))}, nil
+}
+
+func (b *Broker) topicExists(_ context.Context, in *api.TopicName) (*api.TopicExistsInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.topics[in.Name]
+	return &api.TopicExistsInfo{Query: in.Name, Exists: ok}, nil
+}
+
+func (b *Broker) hasTopic(topicID ulid.ULID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, id := range b.topics {
+		if id == topicID {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Broker) topicMap() map[string][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := make(map[string][]byte, len(b.topics))
+	for name, topicID := range b.topics {
+		topics[name] = topicID.Bytes()
+	}
+	return topics
+}
@@ -0,0 +1,206 @@
+package sonartest_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+	"github.com/bbengfort/ensign-sonar/sonartest"
+)
+
+// Publishes pings through the broker to a listener, returning the publisher stats and
+// the sequences received by the listener once every delivered ping has been handled.
+func loopback(t *testing.T, broker *sonartest.Broker, count uint64) (*sonar.Stats, *sonar.SequenceTracker) {
+	t.Helper()
+
+	client, err := broker.Client()
+	if err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+	defer client.Close()
+
+	var (
+		mu       sync.Mutex
+		handled  uint64
+		seqs     = sonar.NewSequenceTracker(1)
+		received = &sonar.Stats{}
+	)
+
+	subscribed := make(chan struct{})
+	listener := sonar.NewListener(client, func(ping *sonar.Ping) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		seqs.Track(ping)
+		received.Observe(ping.Timedelta())
+		return nil
+	}, sonar.SubscribeTo("pings"), sonar.OnSubscribe(func() { close(subscribed) }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listening := make(chan error, 1)
+	go func() { listening <- listener.Listen(ctx) }()
+
+	select {
+	case <-subscribed:
+	case err = <-listening:
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	pub := sonar.NewPublisher(client, "pings", sonar.WithCount(count))
+	if err = pub.Run(context.Background()); err != nil {
+		t.Fatalf("could not publish pings: %s", err)
+	}
+
+	// Wait for every ping to reach the broker and every ping that was not dropped to be
+	// handled; closing the subscription while pings are delivered panics in the client.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		published := broker.Published()
+		delivered := published - broker.Dropped()
+
+		mu.Lock()
+		done := published == count && handled >= delivered
+		mu.Unlock()
+
+		if done {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for pings: %d of %d published, %d of %d delivered handled", published, count, handled, delivered)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err = <-listening; err != nil {
+		t.Fatalf("listener stopped with an error: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	received.Transmitted = pub.Sent()
+	received.Received = seqs.Received()
+	return received, seqs
+}
+
+func TestLoopback(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("pings"))
+	defer broker.Close()
+
+	stats, seqs := loopback(t, broker, 100)
+	if stats.Transmitted != 100 || stats.Received != 100 {
+		t.Fatalf("expected all 100 pings to be received, got %s", stats.Summary())
+	}
+
+	if seqs.Lost() != 0 || seqs.Reordered() != 0 || seqs.Duplicates() != 0 {
+		t.Errorf("expected no lost, reordered, or duplicate pings, got %d lost %d reordered %d duplicates", seqs.Lost(), seqs.Reordered(), seqs.Duplicates())
+	}
+
+	if stats.Count() != 100 {
+		t.Errorf("expected 100 latency observations, got %d", stats.Count())
+	}
+}
+
+func TestLoopbackLoss(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("pings"), sonartest.WithLoss(0.1), sonartest.WithSeed(42))
+	defer broker.Close()
+
+	stats, seqs := loopback(t, broker, 1000)
+
+	dropped := broker.Dropped()
+	if dropped < 50 || dropped > 150 {
+		t.Fatalf("expected about 10%% of 1000 pings to be dropped, dropped %d", dropped)
+	}
+
+	if stats.Received != 1000-dropped {
+		t.Fatalf("expected %d pings received, got %d", 1000-dropped, stats.Received)
+	}
+
+	// Pings dropped after the last ping received are not detected as gaps.
+	if lost := seqs.Lost(); lost > dropped || lost < dropped-5 {
+		t.Errorf("expected about %d pings lost in sequence gaps, got %d", dropped, lost)
+	}
+
+	expected := fmt.Sprintf("1000 pings transmitted, %d received, %0.1f%% loss", 1000-dropped, float64(dropped)/10)
+	if summary := stats.Summary(); summary[:len(expected)] != expected {
+		t.Errorf("expected summary %q, got %q", expected, summary)
+	}
+}
+
+func TestLoopbackReorder(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("pings"), sonartest.WithReorder(0.2), sonartest.WithSeed(42))
+	defer broker.Close()
+
+	stats, seqs := loopback(t, broker, 500)
+	if stats.Received != 500 || seqs.Lost() != 0 {
+		t.Fatalf("expected all pings to be received, got %s with %d lost", stats.Summary(), seqs.Lost())
+	}
+
+	if seqs.Reordered() == 0 {
+		t.Error("expected some pings to be reordered")
+	}
+}
+
+func TestLoopbackLatency(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("pings"), sonartest.WithLatency(5*time.Millisecond))
+	defer broker.Close()
+
+	stats, _ := loopback(t, broker, 10)
+	if stats.Received != 10 {
+		t.Fatalf("expected all pings to be received, got %s", stats.Summary())
+	}
+
+	if stats.Min() < 5*time.Millisecond {
+		t.Errorf("expected the latency to be at least 5ms, got %s", stats.Min())
+	}
+}
+
+func TestUnknownTopic(t *testing.T) {
+	broker := sonartest.New()
+	defer broker.Close()
+
+	client, err := broker.Client()
+	if err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+	defer client.Close()
+
+	if _, err = client.Subscribe("missing"); err == nil {
+		t.Error("expected an error subscribing to an unknown topic")
+	}
+}
+
+func TestListTopics(t *testing.T) {
+	broker := sonartest.New(sonartest.WithTopics("pings", "alpha"))
+	defer broker.Close()
+
+	stats, _ := loopback(t, broker, 5)
+	if stats.Received != 5 {
+		t.Fatalf("expected all pings to be received, got %s", stats.Summary())
+	}
+
+	client, err := broker.Client()
+	if err != nil {
+		t.Fatalf("could not connect to broker: %s", err)
+	}
+	defer client.Close()
+
+	topics, err := client.ListTopics(context.Background())
+	if err != nil {
+		t.Fatalf("could not list topics: %s", err)
+	}
+
+	if len(topics) != 2 || topics[0].Name != "alpha" || topics[1].Name != "pings" {
+		t.Fatalf("expected the alpha and pings topics sorted by name, got %v", topics)
+	}
+
+	if topics[0].Offset != 0 || topics[1].Offset != 5 {
+		t.Errorf("expected the offsets to be the number of events published, got %d and %d", topics[0].Offset, topics[1].Offset)
+	}
+}
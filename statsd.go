@@ -0,0 +1,57 @@
+package sonar
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const DefaultStatsDPrefix = "ensign.sonar"
+
+// StatsD emits ping metrics to a StatsD server using the line protocol over UDP.
+// Because StatsD is fire-and-forget, errors sending metrics are silently ignored.
+type StatsD struct {
+	prefix string
+	conn   net.Conn
+}
+
+func NewStatsD(addr, prefix string) (s *StatsD, err error) {
+	s = &StatsD{prefix: strings.Trim(prefix, ".")}
+	if s.conn, err = net.Dial("udp", addr); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Observe sends a received counter and a latency timer for the ping.
+func (s *StatsD) Observe(p *Ping) {
+	s.Count("received", 1)
+	s.Timing("latency", p.Timedelta())
+}
+
+// Count sends a counter increment for the named metric.
+func (s *StatsD) Count(name string, n int64) {
+	s.send(s.Line(name, fmt.Sprintf("%d", n), "c"))
+}
+
+// Timing sends a timer in milliseconds for the named metric.
+func (s *StatsD) Timing(name string, d time.Duration) {
+	s.send(s.Line(name, fmt.Sprintf("%g", float64(d)/float64(time.Millisecond)), "ms"))
+}
+
+// Line formats a StatsD metric as prefix.name:value|type.
+func (s *StatsD) Line(name, value, kind string) string {
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	return fmt.Sprintf("%s:%s|%s", name, value, kind)
+}
+
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsD) send(line string) {
+	s.conn.Write([]byte(line))
+}
@@ -0,0 +1,71 @@
+package sonar_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	sonar "github.com/bbengfort/ensign-sonar"
+)
+
+func TestStatsDLine(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{"", "received:1|c"},
+		{"ensign.sonar", "ensign.sonar.received:1|c"},
+		{".ensign.sonar.", "ensign.sonar.received:1|c"},
+		{"app", "app.received:1|c"},
+	}
+
+	for _, tc := range tests {
+		s, err := sonar.NewStatsD("127.0.0.1:8125", tc.prefix)
+		if err != nil {
+			t.Fatalf("could not create statsd client: %s", err)
+		}
+
+		if line := s.Line("received", "1", "c"); line != tc.expected {
+			t.Errorf("with prefix %q expected %q, got %q", tc.prefix, tc.expected, line)
+		}
+		s.Close()
+	}
+}
+
+func TestStatsDObserve(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen for statsd metrics: %s", err)
+	}
+	defer server.Close()
+
+	s, err := sonar.NewStatsD(server.LocalAddr().String(), sonar.DefaultStatsDPrefix)
+	if err != nil {
+		t.Fatalf("could not create statsd client: %s", err)
+	}
+	defer s.Close()
+
+	sent := time.Now()
+	s.Observe(&sonar.Ping{Sequence: 1, Timestamp: sent, Received: sent.Add(1500 * time.Microsecond)})
+	s.Count("errors", 3)
+
+	// Each metric is sent in its own datagram.
+	expected := []string{
+		"ensign.sonar.received:1|c",
+		"ensign.sonar.latency:1.5|ms",
+		"ensign.sonar.errors:3|c",
+	}
+
+	buf := make([]byte, 512)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for _, line := range expected {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("could not read statsd metric: %s", err)
+		}
+
+		if received := string(buf[:n]); received != line {
+			t.Errorf("expected metric %q, got %q", line, received)
+		}
+	}
+}
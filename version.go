@@ -14,25 +14,54 @@ const (
 // Set the GitVersion via -ldflags="-X 'github.com/bbengfort/ensign-sonar.GitVersion=$(git rev-parse --short HEAD)'"
 var GitVersion string
 
+// VersionInfo describes the components of the version of the current build so that
+// programs embedding the package do not have to parse the version string.
+type VersionInfo struct {
+	Major         int    `json:"major"`
+	Minor         int    `json:"minor"`
+	Patch         int    `json:"patch"`
+	ReleaseLevel  string `json:"release_level,omitempty"`
+	ReleaseNumber int    `json:"release_number,omitempty"`
+	GitVersion    string `json:"git_version,omitempty"`
+}
+
+// Versions returns the version components of the current build.
+func Versions() VersionInfo {
+	return VersionInfo{
+		Major:         VersionMajor,
+		Minor:         VersionMinor,
+		Patch:         VersionPatch,
+		ReleaseLevel:  VersionReleaseLevel,
+		ReleaseNumber: VersionReleaseNumber,
+		GitVersion:    GitVersion,
+	}
+}
+
 // Version returns the semantic version for the current build.
 func Version() string {
+	return Versions().String()
+}
+
+// String returns the semantic version, omitting the patch version if it is zero and
+// there is no release level, followed by the git version if it is set.
+func (v VersionInfo) String() string {
 	var versionCore string
-	if VersionPatch > 0 || VersionReleaseLevel != "" {
-		versionCore = fmt.Sprintf("%d.%d.%d", VersionMajor, VersionMinor, VersionPatch)
+	if v.Patch > 0 || v.ReleaseLevel != "" {
+		versionCore = fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
 	} else {
-		versionCore = fmt.Sprintf("%d.%d", VersionMajor, VersionMinor)
+		versionCore = fmt.Sprintf("%d.%d", v.Major, v.Minor)
 	}
 
-	if VersionReleaseLevel != "" {
-		if VersionReleaseNumber > 0 {
-			versionCore = fmt.Sprintf("%s-%s.%d", versionCore, VersionReleaseLevel, VersionReleaseNumber)
+	if v.ReleaseLevel != "" {
+		if v.ReleaseNumber > 0 {
+			versionCore = fmt.Sprintf("%s-%s.%d", versionCore, v.ReleaseLevel, v.ReleaseNumber)
 		} else {
-			versionCore = fmt.Sprintf("%s-%s", versionCore, VersionReleaseLevel)
+			versionCore = fmt.Sprintf("%s-%s", versionCore, v.ReleaseLevel)
 		}
 	}
 
-	if GitVersion != "" {
-		versionCore = fmt.Sprintf("%s (%s)", versionCore, GitVersion)
+	if v.GitVersion != "" {
+		versionCore = fmt.Sprintf("%s (%s)", versionCore, v.GitVersion)
 	}
 
 	return versionCore